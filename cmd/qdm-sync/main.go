@@ -1,24 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/urfave/cli/v2"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 
+	"github.com/mirror520/qdm-sync/orders"
 	"github.com/mirror520/qdm-sync/persistence/mongo"
 	"github.com/mirror520/qdm-sync/qdm"
+	"github.com/mirror520/qdm-sync/sinks"
+	"github.com/mirror520/qdm-sync/validation"
 
 	sync "github.com/mirror520/qdm-sync"
 )
 
+// stdout receives the output meant for people, moved to stderr when a stdout
+// sink streams the change events there.
+var stdout io.Writer = os.Stdout
+
 func main() {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -30,74 +45,238 @@ func main() {
 	app := &cli.App{
 		Name:        "QDMSync",
 		Description: "QDMSync uses QDM API to sync e-commerce data to MongoDB, streamlining data management.",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "debug-http",
+				Usage:   "Logs QDM requests and responses with credentials and PII redacted",
+				EnvVars: []string{"QDM_DEBUG_HTTP"},
+			},
+		},
 		Commands: []*cli.Command{
+			{
+				Name:        "config",
+				Description: "Prints the resolved configuration with secrets redacted.",
+				Flags: []cli.Flag{
+					pathFlag(path),
+				},
+				Action: showConfig,
+			},
 			{
 				Name:        "sync",
 				Description: "Initiates data synchronization.",
 				Subcommands: []*cli.Command{
 					{
 						Name: "orders",
-						Flags: []cli.Flag{
-							&cli.StringFlag{
-								Name:    "path",
-								Usage:   "Specifies the working directory",
-								EnvVars: []string{"QDM_PATH"},
-								Value:   path,
+						Flags: append(syncFlags(path),
+							&cli.IntSliceFlag{
+								Name:  "customer-id",
+								Usage: "Only syncs the orders of the given customers, their whole history unless a window is given",
 							},
-							&cli.TimestampFlag{
-								Name:     "start-time",
-								Aliases:  []string{"start", "since"},
-								Layout:   time.RFC3339,
-								Timezone: time.Local,
-								Required: true,
+							&cli.StringFlag{
+								Name:  "customer-ids-file",
+								Usage: "Reads more customer ids from a file, one per line",
 							},
-							&cli.TimestampFlag{
-								Name:     "end-time",
-								Aliases:  []string{"end"},
-								Layout:   time.RFC3339,
-								Timezone: time.Local,
-								Value:    cli.NewTimestamp(time.Now()),
+						),
+						Action: syncOrders,
+					},
+					{
+						Name:   "customers",
+						Flags:  syncFlags(path),
+						Action: syncCustomers,
+					},
+					{
+						Name: "customer-groups",
+						Flags: []cli.Flag{
+							pathFlag(path),
+							dryRunFlag(),
+							waitFlag(),
+							forceFlag(),
+						},
+						Action: syncCustomerGroups,
+					},
+					{
+						Name:        "all",
+						Description: "Syncs customer groups, customers and orders in order.",
+						Flags: append(syncFlags(path),
+							&cli.BoolFlag{
+								Name:  "continue-on-error",
+								Usage: "Keeps syncing the remaining entities when one fails",
 							},
+						),
+						Action: syncAll,
+					},
+				},
+			},
+			{
+				Name:        "verify",
+				Description: "Compares the records counted in QDM with the stored ones.",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "orders",
+						Flags:  verifyFlags(path),
+						Action: verifyOrders,
+					},
+					{
+						Name:   "customers",
+						Flags:  verifyFlags(path),
+						Action: verifyCustomers,
+					},
+				},
+			},
+			{
+				Name:        "validate",
+				Description: "Checks the records of QDM against the validation rules.",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "orders",
+						Flags:  validateFlags(path),
+						Action: validateOrders,
+					},
+					{
+						Name:   "customers",
+						Flags:  validateFlags(path),
+						Action: validateCustomers,
+					},
+				},
+			},
+			{
+				Name:        "reconcile",
+				Description: "Removes the stored records of a window that were deleted in QDM.",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "orders",
+						Flags:  reconcileFlags(path),
+						Action: reconcileOrders,
+					},
+					{
+						Name:   "customers",
+						Flags:  reconcileFlags(path),
+						Action: reconcileCustomers,
+					},
+				},
+			},
+			{
+				Name:        "history",
+				Description: "Prints the recorded versions of a record.",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "order",
+						ArgsUsage: "<id>",
+						Flags: []cli.Flag{
+							pathFlag(path),
 						},
-						Action: syncOrders,
+						Action: orderHistory,
 					},
+				},
+			},
+			{
+				Name:        "aggregate",
+				Description: "Computes aggregates from the stored records.",
+				Subcommands: []*cli.Command{
 					{
-						Name: "customers",
+						Name:        "customers",
+						Description: "Aggregates the stored orders of the customers into customer_stats.",
 						Flags: []cli.Flag{
-							&cli.StringFlag{
-								Name:    "path",
-								Usage:   "Specifies the working directory",
-								EnvVars: []string{"QDM_PATH"},
-								Value:   path,
+							pathFlag(path),
+							&cli.IntSliceFlag{
+								Name:  "customer-id",
+								Usage: "Only aggregates the given customers, printing their stats",
+							},
+							jsonFlag(),
+						},
+						Action: aggregateCustomers,
+					},
+				},
+			},
+			{
+				Name:        "dead-letters",
+				Description: "Inspects, retries and purges the records set aside by the syncs.",
+				Subcommands: []*cli.Command{
+					{
+						Name: "list",
+						Flags: append(deadLetterFlags(path),
+							&cli.IntFlag{
+								Name:  "limit",
+								Usage: "Number of dead letters listed, oldest first",
+								Value: 50,
 							},
-							&cli.TimestampFlag{
-								Name:     "start-time",
-								Aliases:  []string{"start", "since"},
-								Layout:   time.RFC3339,
-								Timezone: time.Local,
-								Required: true,
+							jsonFlag(),
+						),
+						Action: listDeadLetters,
+					},
+					{
+						Name:        "retry",
+						Description: "Stores the dead letters again, removing the ones that succeed.",
+						Subcommands: []*cli.Command{
+							{
+								Name:   "orders",
+								Flags:  retryFlags(path),
+								Action: retryOrders,
 							},
-							&cli.TimestampFlag{
-								Name:     "end-time",
-								Aliases:  []string{"end"},
-								Layout:   time.RFC3339,
-								Timezone: time.Local,
-								Value:    cli.NewTimestamp(time.Now()),
+							{
+								Name:   "customers",
+								Flags:  retryFlags(path),
+								Action: retryCustomers,
 							},
 						},
-						Action: syncCustomers,
 					},
 					{
-						Name: "customer-groups",
+						Name: "purge",
+						Flags: append(deadLetterFlags(path),
+							&cli.BoolFlag{
+								Name:  "all",
+								Usage: "Purges every dead letter when no other filter is set",
+							},
+						),
+						Action: purgeDeadLetters,
+					},
+				},
+			},
+			{
+				Name:        "migrate",
+				Description: "Makes the keys of the collections unique, which syncs require to upsert records.",
+				Flags: []cli.Flag{
+					pathFlag(path),
+					&cli.BoolFlag{
+						Name:  "dedupe",
+						Usage: "Removes all but the latest modified document of the records stored several times",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Reports the duplicates and the indexes without changing them",
+					},
+				},
+				Action: migrate,
+			},
+			{
+				Name:        "runs",
+				Description: "Inspects the ledger of sync runs.",
+				Subcommands: []*cli.Command{
+					{
+						Name: "list",
 						Flags: []cli.Flag{
+							pathFlag(path),
 							&cli.StringFlag{
-								Name:    "path",
-								Usage:   "Specifies the working directory",
-								EnvVars: []string{"QDM_PATH"},
-								Value:   path,
+								Name:  "entity",
+								Usage: "Only lists the runs of orders, customers or customer_groups",
 							},
+							&cli.IntFlag{
+								Name:  "limit",
+								Usage: "Number of runs listed, latest first",
+								Value: 20,
+							},
+							jsonFlag(),
 						},
-						Action: syncCustomerGroups,
+						Action: listRuns,
+					},
+					{
+						Name:      "show",
+						ArgsUsage: "<id>",
+						Flags: []cli.Flag{
+							pathFlag(path),
+							jsonFlag(),
+						},
+						Action: showRun,
 					},
 				},
 			},
@@ -110,168 +289,1218 @@ func main() {
 	}
 }
 
-func syncOrders(cli *cli.Context) error {
-	filepath := filepath.Join(cli.String("path"), "config.yaml")
-
-	f, err := os.Open(filepath)
-	if err != nil {
-		return err
+func pathFlag(path string) cli.Flag {
+	return &cli.StringFlag{
+		Name:    "path",
+		Usage:   "Specifies the working directory",
+		EnvVars: []string{"QDM_PATH"},
+		Value:   path,
 	}
-	defer f.Close()
+}
 
-	var cfg *sync.Config
-	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
-		return err
+// windowFlags select the time window records were added in. With lookback
+// the window may instead trail the end time by a duration.
+func windowFlags(lookback bool) []cli.Flag {
+	flags := []cli.Flag{
+		&cli.TimestampFlag{
+			Name:     "start-time",
+			Aliases:  []string{"start", "since"},
+			Layout:   time.RFC3339,
+			Timezone: time.Local,
+			Required: !lookback,
+		},
+		&cli.TimestampFlag{
+			Name:     "end-time",
+			Aliases:  []string{"end"},
+			Layout:   time.RFC3339,
+			Timezone: time.Local,
+			Value:    cli.NewTimestamp(time.Now()),
+		},
 	}
 
-	qdm, err := qdm.NewService(cfg.QDM)
-	if err != nil {
-		return err
+	if lookback {
+		flags = append(flags, &cli.StringFlag{
+			Name:  "lookback",
+			Usage: "Re-syncs the trailing window (e.g. 30d or 12h) instead of starting at start-time, storing only the records that changed",
+		})
 	}
-	defer qdm.Close()
 
-	repo, err := mongo.NewOrderRepository(cfg.Persistence)
-	if err != nil {
-		return err
-	}
-	defer repo.Disconnected()
+	return flags
+}
 
-	svc := sync.NewService(qdm, repo)
-	defer svc.Close()
+// syncFlags are the flags of the commands syncing a time window.
+func syncFlags(path string) []cli.Flag {
+	return append([]cli.Flag{pathFlag(path)}, append(windowFlags(true),
+		&cli.StringFlag{
+			Name:    "metrics-addr",
+			Usage:   "Exposes Prometheus metrics on the given address (e.g. :9090)",
+			EnvVars: []string{"QDM_METRICS_ADDR"},
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "Number of records stored per batch",
+			Value: 100,
+		},
+		&cli.IntFlag{
+			Name:  "writers",
+			Usage: "Number of batches stored concurrently",
+			Value: 2,
+		},
+		&cli.DurationFlag{
+			Name:  "throttle",
+			Usage: "Minimum interval between batches (e.g. 500ms), 0 disables throttling",
+		},
+		dryRunFlag(),
+		waitFlag(),
+		forceFlag(),
+		&cli.BoolFlag{
+			Name:  "validate",
+			Usage: "Reports the records breaking the validation rules, as with validation.sync",
+		},
+	)...)
+}
 
-	start := *cli.Timestamp("start-time")
+// window returns the time window selected by the window flags.
+func window(cli *cli.Context) (time.Time, time.Time, error) {
 	end := time.Now()
 	if endTS := cli.Timestamp("end-time"); endTS != nil {
 		end = *endTS
 	}
 
-	ch, n, err := svc.SyncOrders(start, end)
-	if err != nil {
-		return err
-	}
+	if lookback := cli.String("lookback"); lookback != "" {
+		d, err := parseLookback(lookback)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
 
-	progress := mpb.New()
-	defer progress.Shutdown()
+		return end.Add(-d), end, nil
+	}
 
-	bar := progress.AddBar(n,
-		mpb.PrependDecorators(
-			decor.Name("synchronizing", decor.WCSyncSpaceR),
-			decor.CountersNoUnit("%d / %d", decor.WCSyncWidth),
-		),
-		mpb.AppendDecorators(decor.Percentage(decor.WC{W: 5})),
-	)
+	start := cli.Timestamp("start-time")
+	if start == nil {
+		return time.Time{}, time.Time{}, exit("start-time or lookback required")
+	}
 
-	for p := range ch {
-		bar.SetCurrent(p.Current)
+	return *start, end, nil
+}
 
-		if bar.Completed() {
-			break
+// parseLookback parses a duration that may also be given in days, e.g. 30d.
+func parseLookback(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
 		}
 	}
 
-	progress.Wait()
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, exit("invalid lookback " + s + ", e.g. 30d or 12h")
+	}
 
-	return nil
+	return d, nil
 }
 
-func syncCustomers(cli *cli.Context) error {
-	filepath := filepath.Join(cli.String("path"), "config.yaml")
+// verifyFlags extend the sync flags, used to re-sync mismatched buckets.
+func verifyFlags(path string) []cli.Flag {
+	return append(syncFlags(path),
+		&cli.DurationFlag{
+			Name:  "bucket",
+			Usage: "Length of the slices the window is compared in",
+			Value: 24 * time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:  "fix",
+			Usage: "Re-syncs the buckets whose counts do not match",
+		},
+	)
+}
+
+func validateFlags(path string) []cli.Flag {
+	return append([]cli.Flag{pathFlag(path)}, append(windowFlags(false),
+		&cli.IntFlag{
+			Name:  "show",
+			Usage: "Number of violations listed, 0 lists them all",
+			Value: 50,
+		},
+		jsonFlag(),
+	)...)
+}
+
+func reconcileFlags(path string) []cli.Flag {
+	return append([]cli.Flag{pathFlag(path)}, append(windowFlags(false),
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Lists the records deleted in QDM without removing them",
+		},
+		waitFlag(),
+		forceFlag(),
+	)...)
+}
+
+func dryRunFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Fetches and compares records with MongoDB without writing them",
+	}
+}
+
+// waitFlag and forceFlag decide what happens when another run holds the lock
+// of the entity; by default the command fails.
+func waitFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "wait",
+		Usage: "Waits for another run holding the lock to finish",
+	}
+}
+
+func forceFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "force",
+		Usage: "Takes over the lock held by another run, e.g. a crashed one",
+	}
+}
 
-	f, err := os.Open(filepath)
+func loadConfig(cli *cli.Context) (*sync.Config, error) {
+	cfg, err := sync.LoadConfig(filepath.Join(cli.String("path"), "config.yaml"))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
 
-	var cfg *sync.Config
-	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
-		return err
+	if cli.Bool("debug-http") {
+		cfg.QDM.DebugHTTP = true
 	}
 
-	qdm, err := qdm.NewService(cfg.QDM)
+	if cfg.QDM.DebugHTTP {
+		log, err := zap.NewDevelopment()
+		if err != nil {
+			return nil, err
+		}
+
+		zap.ReplaceGlobals(log)
+	}
+
+	return cfg, nil
+}
+
+func showConfig(cli *cli.Context) error {
+	cfg, err := loadConfig(cli)
 	if err != nil {
 		return err
 	}
-	defer qdm.Close()
 
-	repo, err := mongo.NewOrderRepository(cfg.Persistence)
+	return yaml.NewEncoder(stdout).Encode(cfg.Redacted())
+}
+
+func syncOrders(cli *cli.Context) error {
+	ids, err := customerIDs(cli)
 	if err != nil {
 		return err
 	}
-	defer repo.Disconnected()
-
-	svc := sync.NewService(qdm, repo)
-	defer svc.Close()
 
-	start := *cli.Timestamp("start-time")
-	end := time.Now()
-	if endTS := cli.Timestamp("end-time"); endTS != nil {
-		end = *endTS
+	var start, end time.Time
+	if len(ids) > 0 && cli.Timestamp("start-time") == nil && cli.String("lookback") == "" {
+		// the whole order history of the customers
+		start, end = historyStart, *cli.Timestamp("end-time")
+	} else {
+		start, end, err = window(cli)
+		if err != nil {
+			return err
+		}
 	}
 
-	ch, n, err := svc.SyncCustomers(start, end)
+	svc, closeAll, err := setup(cli)
 	if err != nil {
 		return err
 	}
+	defer closeAll()
 
-	progress := mpb.New()
-	defer progress.Shutdown()
+	if len(ids) == 0 {
+		run, err := svc.SyncOrders(cli.Context, start, end)
+		if err != nil {
+			return err
+		}
 
-	bar := progress.AddBar(n,
-		mpb.PrependDecorators(
-			decor.Name("synchronizing", decor.WCSyncSpaceR),
-			decor.CountersNoUnit("%d / %d", decor.WCSyncWidth),
-		),
-		mpb.AppendDecorators(decor.Percentage(decor.WC{W: 5})),
-	)
+		return summarize(showProgress(run))
+	}
 
-	for p := range ch {
-		bar.SetCurrent(p.Current)
+	progress := mpb.New(mpb.WithOutput(stdout))
+	defer progress.Shutdown()
 
-		if bar.Completed() {
+	// a customer failing, e.g. while another run holds the lock, does not keep
+	// the others from syncing, nor from being summarized
+	var results []sync.Result
+	for _, id := range ids {
+		if cli.Context.Err() != nil {
 			break
 		}
+
+		var result sync.Result
+
+		run, err := svc.SyncOrders(cli.Context, start, end, qdm.WithCustomerID(id))
+		if err != nil {
+			result.Err = err
+		} else {
+			result = trackRun(progress, run)
+		}
+
+		result.Entity = fmt.Sprintf("orders of customer %d", id)
+		results = append(results, result)
 	}
 
 	progress.Wait()
 
-	return nil
+	return summarize(results...)
 }
 
-func syncCustomerGroups(cli *cli.Context) error {
-	filepath := filepath.Join(cli.String("path"), "config.yaml")
+// historyStart is where the order history of a customer is synced from.
+var historyStart = time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)
+
+// customerIDs returns the customers given by --customer-id and
+// --customer-ids-file, in order and without duplicates.
+func customerIDs(cli *cli.Context) ([]int, error) {
+	ids := cli.IntSlice("customer-id")
+
+	if path := cli.String("customer-ids-file"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			id, err := strconv.Atoi(line)
+			if err != nil || id <= 0 {
+				return nil, exit(fmt.Sprintf("%s:%d: invalid customer id %q", path, n, line))
+			}
+
+			ids = append(ids, id)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[int]bool, len(ids))
+	unique := ids[:0]
+	for _, id := range ids {
+		if id <= 0 {
+			return nil, exit(fmt.Sprintf("invalid customer id %d", id))
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	return unique, nil
+}
 
-	f, err := os.Open(filepath)
+func syncCustomers(cli *cli.Context) error {
+	svc, closeAll, err := setup(cli)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer closeAll()
 
-	var cfg *sync.Config
-	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+	start, end, err := window(cli)
+	if err != nil {
 		return err
 	}
 
-	qdm, err := qdm.NewService(cfg.QDM)
+	run, err := svc.SyncCustomers(cli.Context, start, end)
 	if err != nil {
 		return err
 	}
-	defer qdm.Close()
+
+	return summarize(showProgress(run))
+}
+
+// setup connects the services a sync command needs, the returned func
+// releases them in reverse order.
+func setup(cli *cli.Context) (sync.Service, func(), error) {
+	var closers []func()
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shutdown, err := sync.SetupTracing(cli.Context, cfg.Tracing)
+	if err != nil {
+		return nil, nil, err
+	}
+	closers = append(closers, func() { shutdown(context.Background()) })
+
+	qdm, err := qdm.NewService(cfg.QDM)
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	closers = append(closers, qdm.Close)
 
 	repo, err := mongo.NewOrderRepository(cfg.Persistence)
 	if err != nil {
-		return err
+		closeAll()
+		return nil, nil, err
+	}
+	closers = append(closers, func() { repo.Disconnected() })
+
+	if addr := cli.String("metrics-addr"); addr != "" {
+		srv, err := serveMetrics(addr)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("metrics: %w", err)
+		}
+		closers = append(closers, func() { srv.Close() })
 	}
-	defer repo.Disconnected()
 
-	svc := sync.NewService(qdm, repo)
-	defer svc.Close()
+	opts := append(syncOptions(cli),
+		sync.WithDeleteMode(cfg.Deletion.Mode),
+		sync.WithCustomerStats(cfg.Persistence.CustomerStats),
+	)
 
-	n, err := svc.SyncCustomerGroups()
+	// applied before storing and publishing, so PII reaches neither
+	policies, err := cfg.PII.Options()
 	if err != nil {
-		return err
+		closeAll()
+		return nil, nil, err
 	}
+	opts = append(opts, policies...)
 
-	fmt.Println("record stored: " + strconv.Itoa(n))
-	return nil
+	validator, err := cfg.Validation.Engine()
+	if err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+	opts = append(opts,
+		sync.WithValidator(validator),
+		sync.WithValidation(cfg.Validation.Sync || cli.Bool("validate")),
+	)
+
+	for _, sc := range cfg.Sinks {
+		if sc.Type == "stdout" {
+			stdout = os.Stderr
+		}
+
+		sink, err := sinks.New(sc)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, func() { sink.Close() })
+
+		opts = append(opts, sync.WithEventSink(sink))
+	}
+
+	svc := sync.NewService(qdm, repo, opts...)
+	closers = append(closers, svc.Close)
+
+	return svc, closeAll, nil
+}
+
+func syncOptions(cli *cli.Context) []sync.Option {
+	return []sync.Option{
+		sync.WithBatchSize(cli.Int("batch-size")),
+		sync.WithWriters(cli.Int("writers")),
+		sync.WithThrottle(cli.Duration("throttle")),
+		sync.WithDryRun(cli.Bool("dry-run")),
+		sync.WithChangedOnly(cli.String("lookback") != ""),
+		sync.WithLockWait(cli.Bool("wait")),
+		sync.WithForceLock(cli.Bool("force")),
+	}
+}
+
+// showProgress renders the progress of a run until it is done.
+func showProgress(run *sync.Run) sync.Result {
+	progress := mpb.New(mpb.WithOutput(stdout))
+	defer progress.Shutdown()
+
+	result := trackRun(progress, run)
+	progress.Wait()
+
+	return result
+}
+
+// trackRun adds a bar following the run to progress and returns the result
+// of the run once it is done.
+func trackRun(progress *mpb.Progress, run *sync.Run) sync.Result {
+	// created without total so that it can follow the adjusted totals
+	bar := progress.AddBar(0,
+		mpb.PrependDecorators(
+			decor.Name(run.Entity(), decor.WCSyncSpaceR),
+			decor.CountersNoUnit("%d / %d", decor.WCSyncWidth),
+		),
+		mpb.AppendDecorators(decor.Percentage(decor.WC{W: 5})),
+	)
+
+	total := run.Total()
+	bar.SetTotal(total, false)
+
+	for p := range run.Progress() {
+		if p.Total != total {
+			total = p.Total
+			bar.SetTotal(total, false)
+		}
+
+		bar.SetCurrent(p.Current)
+	}
+
+	result := run.Wait()
+	if result.Err != nil {
+		bar.Abort(false)
+	} else {
+		bar.SetTotal(-1, true)
+	}
+
+	return result
+}
+
+// summarize prints the results of runs and turns their errors into a non-zero
+// exit code.
+func summarize(results ...sync.Result) error {
+	var (
+		total  sync.Result
+		failed []string
+	)
+
+	for _, result := range results {
+		if result.DryRun {
+			showChanges(result)
+		}
+
+		fmt.Fprintln(stdout, result.String())
+
+		for _, w := range result.Warnings {
+			fmt.Fprintln(stdout, "warning: "+w.Error())
+		}
+
+		if len(result.Violations) > 0 {
+			showViolations(result.Violations, 10)
+		}
+
+		if result.ID != "" {
+			fmt.Fprintf(stdout, "run %s, %d API calls\n", result.ID, result.APICalls)
+		}
+
+		total.Stored += result.Stored
+		total.Created += result.Created
+		total.Updated += result.Updated
+		total.Unchanged += result.Unchanged
+		total.ChangedOnly = total.ChangedOnly || result.ChangedOnly
+		total.Skipped += result.Skipped
+		total.Failed += result.Failed
+		total.Duration += result.Duration
+		total.DryRun = total.DryRun || result.DryRun
+		total.Changes = append(total.Changes, result.Changes...)
+
+		if result.Err != nil {
+			failed = append(failed, "sync "+result.Entity+" failed: "+result.Err.Error())
+		}
+	}
+
+	if len(results) > 1 {
+		total.Entity = "total"
+
+		fmt.Fprintln(stdout, total.String())
+	}
+
+	if len(failed) > 0 {
+		return exit(strings.Join(failed, "\n"))
+	}
+
+	return nil
+}
+
+// exit fails the command with a message and a non-zero exit code.
+func exit(msg string) error {
+	return cli.Exit(msg, 1)
+}
+
+// showChanges lists the records a dry run would have created or updated.
+func showChanges(result sync.Result) {
+	for _, c := range result.Changes {
+		switch c.Type {
+		case orders.Created:
+			fmt.Fprintf(stdout, "%s %d: created\n", result.Entity, c.ID)
+
+		case orders.Updated:
+			fmt.Fprintf(stdout, "%s %d: updated %s\n", result.Entity, c.ID, strings.Join(c.Fields, ", "))
+		}
+	}
+}
+
+func syncCustomerGroups(cli *cli.Context) error {
+	svc, closeAll, err := setup(cli)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	run, err := svc.SyncCustomerGroups(cli.Context)
+	if err != nil {
+		return err
+	}
+
+	return summarize(run.Wait())
+}
+
+func syncAll(cli *cli.Context) error {
+	svc, closeAll, err := setup(cli)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	start, end, err := window(cli)
+	if err != nil {
+		return err
+	}
+
+	progress := mpb.New(mpb.WithOutput(stdout))
+	defer progress.Shutdown()
+
+	var results []sync.Result
+	for run := range svc.SyncAll(cli.Context, start, end, cli.Bool("continue-on-error")) {
+		results = append(results, trackRun(progress, run))
+	}
+
+	progress.Wait()
+
+	return summarize(results...)
+}
+
+func verifyOrders(cli *cli.Context) error {
+	return verify(cli, "orders")
+}
+
+func verifyCustomers(cli *cli.Context) error {
+	return verify(cli, "customers")
+}
+
+// verify prints the gap report of an entity and re-syncs the mismatched
+// buckets when asked to.
+func verify(cli *cli.Context, entity string) error {
+	svc, closeAll, err := setup(cli)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	start, end, err := window(cli)
+	if err != nil {
+		return err
+	}
+
+	bs, err := svc.Verify(cli.Context, entity, start, end, cli.Duration("bucket"))
+	if err != nil {
+		return err
+	}
+
+	var gaps []sync.Bucket
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "START\tEND\tQDM\tSTORED\tMISSING")
+	for _, b := range bs {
+		mark := ""
+		if !b.Matched() {
+			mark = "\t<-"
+			gaps = append(gaps, b)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d%s\n",
+			b.Start.Format(time.DateTime), b.End.Format(time.DateTime),
+			b.Expected, b.Stored, b.Missing(), mark)
+	}
+	w.Flush()
+
+	fmt.Fprintf(stdout, "%d of %d buckets mismatched\n", len(gaps), len(bs))
+
+	if len(gaps) == 0 {
+		return nil
+	}
+
+	if !cli.Bool("fix") {
+		return exit(entity + " has gaps, rerun with --fix to backfill them")
+	}
+
+	resync := svc.SyncCustomers
+	if entity == "orders" {
+		resync = func(ctx context.Context, start time.Time, end time.Time) (*sync.Run, error) {
+			return svc.SyncOrders(ctx, start, end)
+		}
+	}
+
+	progress := mpb.New(mpb.WithOutput(stdout))
+	defer progress.Shutdown()
+
+	var results []sync.Result
+	for _, b := range gaps {
+		run, err := resync(cli.Context, b.Start, b.End)
+		if err != nil {
+			return err
+		}
+
+		results = append(results, trackRun(progress, run))
+	}
+
+	progress.Wait()
+
+	return summarize(results...)
+}
+
+func validateOrders(cli *cli.Context) error {
+	return validate(cli, "orders")
+}
+
+func validateCustomers(cli *cli.Context) error {
+	return validate(cli, "customers")
+}
+
+// validate prints the violations of an entity and exits non-zero when there
+// are any.
+func validate(cli *cli.Context, entity string) error {
+	svc, closeAll, err := setup(cli)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	start, end, err := window(cli)
+	if err != nil {
+		return err
+	}
+
+	report, err := svc.Validate(cli.Context, entity, start, end)
+	if err != nil {
+		return exit("validate " + entity + " failed: " + err.Error())
+	}
+
+	if cli.Bool("json") {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		showViolations(report.Violations, cli.Int("show"))
+
+		for _, c := range report.ByRule() {
+			fmt.Fprintf(stdout, "%s: %d\n", c.Rule, c.Count)
+		}
+
+		fmt.Fprintf(stdout, "%s: %d records checked, %d violations\n", entity, report.Checked, len(report.Violations))
+	}
+
+	if len(report.Violations) > 0 {
+		return exit(fmt.Sprintf("%d violations found", len(report.Violations)))
+	}
+
+	return nil
+}
+
+// showViolations lists up to limit violations, all of them when limit is 0.
+func showViolations(violations []validation.Violation, limit int) {
+	for i, v := range violations {
+		if limit > 0 && i == limit {
+			fmt.Fprintf(stdout, "... %d more violations\n", len(violations)-limit)
+			break
+		}
+
+		fmt.Fprintln(stdout, "violation: "+v.String())
+	}
+}
+
+func reconcileOrders(cli *cli.Context) error {
+	return reconcile(cli, "orders")
+}
+
+func reconcileCustomers(cli *cli.Context) error {
+	return reconcile(cli, "customers")
+}
+
+// reconcile removes the records of an entity deleted in QDM and lists their
+// IDs.
+func reconcile(cli *cli.Context, entity string) error {
+	svc, closeAll, err := setup(cli)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	start, end, err := window(cli)
+	if err != nil {
+		return err
+	}
+
+	report, err := svc.ReconcileDeleted(cli.Context, entity, start, end)
+	if err != nil {
+		return exit("reconcile " + entity + " failed: " + err.Error())
+	}
+
+	for _, id := range report.IDs {
+		fmt.Fprintf(stdout, "%s %d: deleted\n", entity, id)
+	}
+
+	action := string(report.Mode) + " deleted"
+	if report.DryRun {
+		action = "to be " + action + " (dry run)"
+	}
+
+	fmt.Fprintf(stdout, "%s: %d records %s\n", entity, len(report.IDs), action)
+
+	for _, w := range report.Warnings {
+		fmt.Fprintln(stdout, "warning: "+w.Error())
+	}
+
+	return nil
+}
+
+// orderHistory prints the timeline of an order from order_history.
+func orderHistory(cli *cli.Context) error {
+	id, err := strconv.Atoi(cli.Args().First())
+	if err != nil {
+		return exit("order id required: " + cli.Args().First())
+	}
+
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	repo, err := mongo.NewOrderRepository(cfg.Persistence)
+	if err != nil {
+		return err
+	}
+	defer repo.Disconnected()
+
+	history, err := repo.OrderHistory(cli.Context, id)
+	if err != nil {
+		return err
+	}
+
+	if len(history) == 0 {
+		return exit(fmt.Sprintf("no history for order %d, is persistence.history enabled?", id))
+	}
+
+	for _, v := range history {
+		fmt.Fprintf(stdout, "v%d  %s  modified %s  status %s  total %s\n",
+			v.Version,
+			v.RecordedAt.Local().Format(time.DateTime),
+			time.Time(v.DateModified).Format(time.DateTime),
+			abbreviate(v.Snapshot.Lookup("order_status")),
+			abbreviate(v.Snapshot.Lookup("total")),
+		)
+
+		for _, c := range v.Changes {
+			fmt.Fprintf(stdout, "    %s: %s -> %s\n", c.Field, abbreviate(c.Old), abbreviate(c.New))
+		}
+	}
+
+	return nil
+}
+
+// aggregateCustomers refreshes customer_stats, of every customer unless
+// --customer-id is given.
+func aggregateCustomers(cli *cli.Context) error {
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	repo, err := mongo.NewOrderRepository(cfg.Persistence)
+	if err != nil {
+		return err
+	}
+	defer repo.Disconnected()
+
+	ids := cli.IntSlice("customer-id")
+
+	begin := time.Now()
+	n, err := repo.AggregateCustomerStats(cli.Context, ids)
+	if err != nil {
+		return exit("aggregate customers failed: " + err.Error())
+	}
+
+	if len(ids) == 0 {
+		fmt.Fprintf(stdout, "customer_stats: %d customers aggregated in %s\n", n, time.Since(begin).Round(time.Millisecond))
+		return nil
+	}
+
+	stats, err := repo.CustomerStats(cli.Context, ids)
+	if err != nil {
+		return err
+	}
+
+	if cli.Bool("json") {
+		return printJSON(stats)
+	}
+
+	fmt.Fprintf(stdout, "customer_stats: %d customers aggregated in %s\n", n, time.Since(begin).Round(time.Millisecond))
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CUSTOMER\tORDERS\tFIRST\tLAST\tTOTAL\tAVERAGE\tCANCELLED\tRETURNED\tFAVOURITE")
+
+	for _, s := range stats {
+		favourite := "-"
+		if len(s.FavouriteProducts) > 0 {
+			p := s.FavouriteProducts[0]
+			favourite = fmt.Sprintf("%s (%d)", p.Name, p.Quantity)
+		}
+
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%.2f\t%.2f\t%d\t%d\t%s\n",
+			s.CustomerID,
+			s.OrderCount,
+			s.FirstOrderAt.Local().Format(time.DateOnly),
+			s.LastOrderAt.Local().Format(time.DateOnly),
+			s.TotalAmount,
+			s.AverageOrderValue,
+			s.CancelledCount,
+			s.ReturnedCount,
+			favourite,
+		)
+	}
+
+	return w.Flush()
+}
+
+// migrate creates the unique indexes of the keys, removing the duplicates
+// left by older versions only with --dedupe.
+func migrate(cli *cli.Context) error {
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	dryRun := cli.Bool("dry-run")
+
+	report, err := mongo.Migrate(cli.Context, cfg.Persistence, cli.Bool("dedupe"), dryRun)
+
+	var blocked bool
+	for _, m := range report {
+		switch {
+		case m.Index == "unique":
+			fmt.Fprintf(stdout, "%s: %s is unique\n", m.Collection, m.Key)
+			continue
+
+		case m.Migrated:
+			fmt.Fprintf(stdout, "%s: %s index %sd, %d duplicate documents of %d records removed\n",
+				m.Collection, m.Key, m.Index, m.Removed, m.Records)
+			continue
+		}
+
+		fmt.Fprintf(stdout, "%s: %s index to %s, %d duplicate documents of %d records\n",
+			m.Collection, m.Key, m.Index, m.Duplicates, m.Records)
+
+		if m.Duplicates > 0 {
+			blocked = true
+		}
+	}
+
+	if err != nil {
+		return exit("migrate failed: " + err.Error())
+	}
+
+	switch {
+	case dryRun:
+		fmt.Fprintln(stdout, "dry run, nothing changed")
+
+	case blocked:
+		return exit("duplicates left, run with --dedupe to remove them, keeping the latest modified document of every record")
+	}
+
+	return nil
+}
+
+// deadLetterFlags select the dead letters listed or purged.
+func deadLetterFlags(path string) []cli.Flag {
+	return []cli.Flag{
+		pathFlag(path),
+		&cli.StringFlag{
+			Name:  "entity",
+			Usage: "Only selects the dead letters of orders or customers",
+		},
+		&cli.StringFlag{
+			Name:  "run",
+			Usage: "Only selects the dead letters of the given run",
+		},
+	}
+}
+
+func retryFlags(path string) []cli.Flag {
+	return []cli.Flag{
+		pathFlag(path),
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Decodes and compares the dead letters with MongoDB without writing them",
+		},
+		waitFlag(),
+		forceFlag(),
+	}
+}
+
+func deadLetterFilter(cli *cli.Context) orders.DeadLetterFilter {
+	return orders.DeadLetterFilter{
+		Entity: cli.String("entity"),
+		RunID:  cli.String("run"),
+		Limit:  cli.Int("limit"),
+	}
+}
+
+func listDeadLetters(cli *cli.Context) error {
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	repo, err := mongo.NewOrderRepository(cfg.Persistence)
+	if err != nil {
+		return err
+	}
+	defer repo.Disconnected()
+
+	letters, err := repo.DeadLetters(cli.Context, deadLetterFilter(cli))
+	if err != nil {
+		return err
+	}
+
+	if cli.Bool("json") {
+		return printJSON(letters)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tENTITY\tRECORD\tSTAGE\tATTEMPTS\tCREATED\tRUN\tERROR")
+
+	for _, l := range letters {
+		record := "-"
+		if l.RecordID > 0 {
+			record = strconv.Itoa(l.RecordID)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			l.ID,
+			l.Entity,
+			record,
+			l.Stage,
+			l.Attempts,
+			l.CreatedAt.Local().Format(time.DateTime),
+			l.RunID,
+			l.Error,
+		)
+	}
+
+	return w.Flush()
+}
+
+func retryOrders(cli *cli.Context) error {
+	return retry(cli, "orders")
+}
+
+func retryCustomers(cli *cli.Context) error {
+	return retry(cli, "customers")
+}
+
+func retry(cli *cli.Context, entity string) error {
+	svc, closeAll, err := setup(cli)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	report, err := svc.RetryDeadLetters(cli.Context, entity)
+	if err != nil {
+		return exit("retry " + entity + " failed: " + err.Error())
+	}
+
+	suffix := ""
+	if report.DryRun {
+		suffix = " (dry run)"
+	}
+
+	fmt.Fprintf(stdout, "%s%s: %d dead letters retried, %d stored, %d failed\n",
+		entity, suffix, report.Total, report.Stored, report.Failed)
+
+	if report.Failed > 0 {
+		return exit(fmt.Sprintf("%d dead letters still failing, see dead-letters list", report.Failed))
+	}
+
+	return nil
+}
+
+func purgeDeadLetters(cli *cli.Context) error {
+	filter := deadLetterFilter(cli)
+	if filter.Entity == "" && filter.RunID == "" && !cli.Bool("all") {
+		return exit("--entity, --run or --all required")
+	}
+
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	repo, err := mongo.NewOrderRepository(cfg.Persistence)
+	if err != nil {
+		return err
+	}
+	defer repo.Disconnected()
+
+	n, err := repo.DeleteDeadLetters(cli.Context, filter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%d dead letters purged\n", n)
+
+	return nil
+}
+
+func jsonFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "json",
+		Usage: "Prints JSON instead of a table",
+	}
+}
+
+func listRuns(cli *cli.Context) error {
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	repo, err := mongo.NewOrderRepository(cfg.Persistence)
+	if err != nil {
+		return err
+	}
+	defer repo.Disconnected()
+
+	runs, err := repo.SyncRuns(cli.Context, cli.String("entity"), cli.Int("limit"))
+	if err != nil {
+		return err
+	}
+
+	if cli.Bool("json") {
+		return printJSON(runs)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tENTITY\tSTARTED\tDURATION\tSTORED\tSKIPPED\tFAILED\tAPI CALLS\tOUTCOME")
+
+	for _, run := range runs {
+		outcome := string(run.Outcome)
+		if run.DryRun {
+			outcome += " (dry run)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\n",
+			run.ID,
+			run.Entity,
+			run.StartedAt.Local().Format(time.DateTime),
+			runDuration(run),
+			run.Stored,
+			run.Skipped,
+			run.Failed,
+			run.APICalls,
+			outcome,
+		)
+	}
+
+	return w.Flush()
+}
+
+func showRun(cli *cli.Context) error {
+	id := cli.Args().First()
+	if id == "" {
+		return exit("run id required")
+	}
+
+	cfg, err := loadConfig(cli)
+	if err != nil {
+		return err
+	}
+
+	repo, err := mongo.NewOrderRepository(cfg.Persistence)
+	if err != nil {
+		return err
+	}
+	defer repo.Disconnected()
+
+	run, err := repo.SyncRun(cli.Context, id)
+	if err != nil {
+		return err
+	}
+
+	if cli.Bool("json") {
+		return printJSON(run)
+	}
+
+	window := "-"
+	if !run.Start.IsZero() {
+		window = run.Start.Local().Format(time.RFC3339) + " ~ " + run.End.Local().Format(time.RFC3339)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", run.ID)
+	fmt.Fprintf(w, "Entity:\t%s\n", run.Entity)
+	fmt.Fprintf(w, "Window:\t%s\n", window)
+	fmt.Fprintf(w, "Options:\tbatch size %d, %d writers, throttle %s, dry run %t\n",
+		run.BatchSize, run.Writers, run.Throttle, run.DryRun)
+	fmt.Fprintf(w, "Started:\t%s\n", run.StartedAt.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "Duration:\t%s\n", runDuration(run))
+	fmt.Fprintf(w, "Records:\t%d stored, %d unchanged, %d skipped, %d failed\n",
+		run.Stored, run.Unchanged, run.Skipped, run.Failed)
+	if run.Created+run.Updated > 0 {
+		fmt.Fprintf(w, "Changes:\t%d created, %d updated\n", run.Created, run.Updated)
+	}
+	fmt.Fprintf(w, "API calls:\t%d\n", run.APICalls)
+	fmt.Fprintf(w, "Violations:\t%d\n", run.Violations)
+	fmt.Fprintf(w, "Outcome:\t%s\n", run.Outcome)
+
+	if run.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", run.Error)
+	}
+
+	for _, warning := range run.Warnings {
+		fmt.Fprintf(w, "Warning:\t%s\n", warning)
+	}
+
+	return w.Flush()
+}
+
+// runDuration is the duration of a finished run, or "-" while it runs.
+func runDuration(run orders.SyncRun) string {
+	if run.FinishedAt.IsZero() {
+		return "-"
+	}
+
+	return run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond).String()
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// abbreviate shortens the value of a changed field to fit a line.
+func abbreviate(v bson.RawValue) string {
+	if v.Type == 0 {
+		return "(none)"
+	}
+
+	s := []rune(v.String())
+	if len(s) > 60 {
+		return string(s[:57]) + "..."
+	}
+
+	return string(s)
 }
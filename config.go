@@ -1,13 +1,322 @@
 package sync
 
-import "github.com/mirror520/qdm-sync/qdm"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/pii"
+	"github.com/mirror520/qdm-sync/qdm"
+	"github.com/mirror520/qdm-sync/validation"
+)
 
 type Config struct {
-	QDM         qdm.Config  `yaml:"qdm"`
-	Persistence Persistence `yaml:"persistence"`
+	QDM          qdm.Config  `yaml:"qdm"`
+	Persistence  Persistence `yaml:"persistence"`
+	Tracing      Tracing     `yaml:"tracing"`
+	Deletion     Deletion    `yaml:"deletion"`
+	Sinks        []Sink      `yaml:"sinks"`
+	PII          PII         `yaml:"pii"`
+	Validation   Validation  `yaml:"validation"`
+	Encrypted    string      `yaml:"encrypted"`    // age encrypted (armored) YAML merged over this config
+	IdentityFile string      `yaml:"identityFile"` // age identity used to decrypt the encrypted section
 }
 
 type Persistence struct {
 	Address  string `yaml:"address"`
 	Database string `yaml:"database"`
+	History  bool   `yaml:"history"` // keeps every version of the orders in order_history
+
+	// CustomerStats refreshes the customer_stats of the customers whose orders
+	// a sync stored.
+	CustomerStats bool `yaml:"customerStats"`
+
+	// Mappings reshape the documents of a collection (orders, customers or
+	// customer_groups) before they are stored.
+	Mappings map[string][]Mapping `yaml:"mappings"`
+}
+
+// Mapping is one step of a document mapping; exactly one of Rename, Drop, Set
+// or Derive names the field it applies to.
+type Mapping struct {
+	Rename string `yaml:"rename"` // field renamed to To
+	To     string `yaml:"to"`
+	Drop   string `yaml:"drop"` // field removed
+	Set    string `yaml:"set"`  // field set to Value
+	Value  any    `yaml:"value"`
+	Derive string `yaml:"derive"` // field set to the result of Expr
+	Expr   string `yaml:"expr"`   // expr-lang expression over the fields of the document
+}
+
+// Deletion configures how records removed in QDM are reconciled.
+type Deletion struct {
+	Mode orders.DeleteMode `yaml:"mode"` // soft (default) or hard
+}
+
+// Sink configures where the change events of the syncs are published.
+type Sink struct {
+	Type    string            `yaml:"type"`    // file, stdout, webhook or nats
+	Path    string            `yaml:"path"`    // NDJSON file (file)
+	URL     string            `yaml:"url"`     // endpoint (webhook) or server (nats)
+	Subject string            `yaml:"subject"` // subject prefix (nats), defaults to qdm-sync
+	Headers map[string]string `yaml:"headers"` // extra request headers (webhook)
+	Timeout time.Duration     `yaml:"timeout"` // request timeout (webhook, nats)
+}
+
+// PII sets what happens to the personal data of orders and customers before
+// they are stored or published, by bson field path (e.g. email or
+// address_info.address): keep, drop, mask or hash.
+type PII struct {
+	Salt      qdm.Secret            `yaml:"salt"` // salt of the hashes, keep it stable to keep them joinable
+	Orders    map[string]pii.Action `yaml:"orders"`
+	Customers map[string]pii.Action `yaml:"customers"`
+}
+
+// Options turns the policies into transforms of the sync service, and into
+// redactions of the dead letters, which keep the records untransformed.
+func (cfg PII) Options() ([]Option, error) {
+	var opts []Option
+
+	if len(cfg.Orders) > 0 {
+		hook, err := pii.Hook[orders.Order](string(cfg.Salt), cfg.Orders)
+		if err != nil {
+			return nil, fmt.Errorf("pii.orders: %w", err)
+		}
+
+		redact, err := pii.Redact[orders.Order](string(cfg.Salt), cfg.Orders)
+		if err != nil {
+			return nil, fmt.Errorf("pii.orders: %w", err)
+		}
+
+		opts = append(opts,
+			WithOrderTransform(hook),
+			WithDeadLetterRedaction("orders", redact),
+		)
+	}
+
+	if len(cfg.Customers) > 0 {
+		hook, err := pii.Hook[orders.Customer](string(cfg.Salt), cfg.Customers)
+		if err != nil {
+			return nil, fmt.Errorf("pii.customers: %w", err)
+		}
+
+		redact, err := pii.Redact[orders.Customer](string(cfg.Salt), cfg.Customers)
+		if err != nil {
+			return nil, fmt.Errorf("pii.customers: %w", err)
+		}
+
+		opts = append(opts,
+			WithCustomerTransform(hook),
+			WithDeadLetterRedaction("customers", redact),
+		)
+	}
+
+	return opts, nil
+}
+
+// Validation configures the business rules orders and customers are checked
+// against by the validate command, and by every sync when Sync is set.
+type Validation struct {
+	Sync      bool              `yaml:"sync"`
+	Disabled  []string          `yaml:"disabled"` // built-in rules turned off
+	Orders    []validation.Spec `yaml:"orders"`
+	Customers []validation.Spec `yaml:"customers"`
+}
+
+// Engine compiles the rules.
+func (cfg Validation) Engine() (*validation.Engine, error) {
+	return validation.New(cfg.Disabled, cfg.Orders, cfg.Customers)
+}
+
+// LoadConfig reads the configuration at path, expanding ${VAR} references
+// from the environment, merging the decrypted encrypted section and resolving
+// the QDM credentials.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	if err := expandEnv(&doc); err != nil {
+		return nil, err
+	}
+
+	var cfg *Config
+	if err := doc.Decode(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg == nil {
+		return nil, errors.New("empty config")
+	}
+
+	if cfg.Encrypted != "" {
+		identity := cfg.IdentityFile
+		if env, ok := os.LookupEnv("QDM_AGE_IDENTITY"); ok {
+			identity = env
+		}
+
+		if identity == "" {
+			return nil, errors.New("identityFile required to decrypt the encrypted section")
+		}
+
+		if !filepath.IsAbs(identity) {
+			identity = filepath.Join(filepath.Dir(path), identity)
+		}
+
+		plain, err := decrypt(cfg.Encrypted, identity)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.Unmarshal(plain, cfg); err != nil {
+			return nil, err
+		}
+
+		cfg.Encrypted = ""
+	}
+
+	// credentials are checked by the QDM service, commands working on MongoDB
+	// alone do not need them
+	if err := cfg.QDM.Resolve(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Deletion.Mode == "" {
+		cfg.Deletion.Mode = orders.SoftDelete
+	}
+
+	if err := cfg.Deletion.Mode.Validate(); err != nil {
+		return nil, err
+	}
+
+	if _, err := cfg.PII.Options(); err != nil {
+		return nil, err
+	}
+
+	if _, err := cfg.Validation.Engine(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Redacted returns a copy of the configuration safe to print: the passwords
+// and query values of URLs and the values of headers are replaced, besides
+// the secrets, which are never printed.
+func (cfg Config) Redacted() Config {
+	cfg.QDM.Proxy = redactURL(cfg.QDM.Proxy)
+	cfg.QDM.Headers = redactHeaders(cfg.QDM.Headers)
+	cfg.Persistence.Address = redactURL(cfg.Persistence.Address)
+	cfg.Tracing.Endpoint = redactURL(cfg.Tracing.Endpoint)
+	cfg.Tracing.Headers = redactHeaders(cfg.Tracing.Headers)
+
+	sinks := make([]Sink, len(cfg.Sinks))
+	for i, sink := range cfg.Sinks {
+		sink.URL = redactURL(sink.URL)
+		sink.Headers = redactHeaders(sink.Headers)
+		sinks[i] = sink
+	}
+	cfg.Sinks = sinks
+
+	return cfg
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	userinfoPattern = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9+.-]*://[^:/@]*:)[^@/]*@`)
+	queryPattern    = regexp.MustCompile(`([?&][^=&#]+=)[^&#]*`)
+)
+
+// redactURL replaces the password and the query values of a URL, which is
+// matched as text since MongoDB addresses may list several hosts.
+func redactURL(u string) string {
+	u = userinfoPattern.ReplaceAllString(u, "${1}"+redacted+"@")
+	return queryPattern.ReplaceAllString(u, "${1}"+redacted)
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+
+	redactedHeaders := make(map[string]string, len(headers))
+	for k := range headers {
+		redactedHeaders[k] = redacted
+	}
+
+	return redactedHeaders
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} in the scalar values of the document with the
+// value of the environment variable. Only the braced form is expanded so that
+// a literal $ in a secret stays intact.
+func expandEnv(node *yaml.Node) error {
+	var missing []string
+
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Kind == yaml.ScalarNode {
+			n.Value = envPattern.ReplaceAllStringFunc(n.Value, func(match string) string {
+				name := envPattern.FindStringSubmatch(match)[1]
+
+				val, ok := os.LookupEnv(name)
+				if !ok {
+					missing = append(missing, name)
+				}
+
+				return val
+			})
+		}
+
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+
+	walk(node)
+
+	if len(missing) > 0 {
+		return errors.New("undefined environment variables: " + strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+func decrypt(encrypted string, identityFile string) ([]byte, error) {
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(encrypted))), identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
 }
@@ -0,0 +1,270 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/qdm"
+)
+
+// deadLettered reports that records of a batch were set aside as dead
+// letters; the rest of the batch was stored and the sync goes on.
+type deadLettered struct {
+	n int
+}
+
+func (e *deadLettered) Error() string {
+	return fmt.Sprintf("%d records set aside as dead letters", e.n)
+}
+
+// deadLettering sets aside the records of a batch that cannot be decoded or
+// that the repository rejects. A rejected batch is stored again record by
+// record and only the records still rejected become dead letters, keeping
+// the records as they were before the transforms so that a retry transforms
+// them once. Any other failure, e.g. of the connection, fails the sync. Dry
+// runs only count the letters.
+func (svc *service) deadLettering(run *Run, store storeFunc) storeFunc {
+	return func(ctx context.Context, items []any) error {
+		var letters []orders.DeadLetter
+
+		valid := make([]any, 0, len(items))
+		for _, item := range items {
+			if invalid, ok := item.(*qdm.Invalid); ok {
+				letters = append(letters, newDeadLetter(run, "decode", 0, invalid.Raw, invalid.Err))
+				continue
+			}
+
+			valid = append(valid, item)
+		}
+
+		if len(valid) > 0 {
+			err := store(ctx, valid)
+			if err != nil && (ctx.Err() != nil || !errors.Is(err, orders.ErrRejected)) {
+				return err
+			}
+
+			if err != nil && len(valid) == 1 {
+				letters = append(letters, rejectedLetter(run, valid[0], err))
+			} else if err != nil {
+				for _, item := range valid {
+					err := store(ctx, []any{item})
+					if err == nil {
+						continue
+					}
+
+					if ctx.Err() != nil || !errors.Is(err, orders.ErrRejected) {
+						return err
+					}
+
+					letters = append(letters, rejectedLetter(run, item, err))
+				}
+			}
+		}
+
+		if len(letters) == 0 {
+			return nil
+		}
+
+		if redact := svc.opts.redactions[run.entity]; redact != nil {
+			for i, l := range letters {
+				letters[i].Payload = string(redact([]byte(l.Payload)))
+			}
+		}
+
+		if !svc.opts.dryRun {
+			if err := svc.orders.StoreDeadLetters(ctx, letters); err != nil {
+				return fmt.Errorf("dead letters not stored: %w", err)
+			}
+		}
+
+		for _, l := range letters {
+			svc.log.Warn("record set aside",
+				zap.String("action", "dead_letter"),
+				zap.String("entity", l.Entity),
+				zap.String("run", l.RunID),
+				zap.String("stage", l.Stage),
+				zap.Int("record_id", l.RecordID),
+				zap.String("error", l.Error),
+			)
+		}
+
+		return &deadLettered{n: len(letters)}
+	}
+}
+
+// rejectedLetter is the dead letter of a record the repository rejected.
+func rejectedLetter(run *Run, item any, err error) orders.DeadLetter {
+	payload, _ := json.Marshal(item)
+	return newDeadLetter(run, "store", recordID(item), payload, err)
+}
+
+func newDeadLetter(run *Run, stage string, id int, payload []byte, err error) orders.DeadLetter {
+	now := time.Now()
+
+	return orders.DeadLetter{
+		ID:        uuid.NewString(),
+		RunID:     run.id,
+		Entity:    run.entity,
+		RecordID:  id,
+		Stage:     stage,
+		Payload:   string(payload),
+		Error:     err.Error(),
+		Attempts:  1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func recordID(item any) int {
+	switch r := item.(type) {
+	case orders.Order:
+		return r.OrderID
+
+	case orders.Customer:
+		return r.CustomerID
+	}
+
+	return 0
+}
+
+// Retried reports a retry of the dead letters of an entity.
+type Retried struct {
+	Entity string
+	Total  int // 重試筆數
+	Stored int // 成功並移除的筆數
+	Failed int // 再次失敗的筆數
+	DryRun bool
+}
+
+// RetryDeadLetters decodes and stores the dead letters of the entity again,
+// through the same transforms and sinks as a sync. The letters stored are
+// removed, the others keep their latest error.
+func (svc *service) RetryDeadLetters(ctx context.Context, entity string) (*Retried, error) {
+	var (
+		decode func(payload []byte) (any, error)
+		store  storeFunc
+		diff   diffFunc
+	)
+
+	switch entity {
+	case "orders":
+		decode = decodeAs[orders.Order]
+		store = storeAs(svc.orders.Store)
+		diff = diffAs(svc.orders.Diff)
+
+	case "customers":
+		decode = decodeAs[orders.Customer]
+		store = storeAs(svc.orders.StoreCustomers)
+		diff = diffAs(svc.orders.DiffCustomers)
+
+	default:
+		return nil, errors.New("entity not retriable: " + entity)
+	}
+
+	ctx, span := tracer.Start(ctx, "retry."+entity)
+	defer span.End()
+
+	ctx, release, err := svc.lock(ctx, entity, uuid.NewString())
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	defer release()
+
+	letters, err := svc.orders.DeadLetters(ctx, orders.DeadLetterFilter{Entity: entity})
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	report := &Retried{
+		Entity: entity,
+		Total:  len(letters),
+		DryRun: svc.opts.dryRun,
+	}
+
+	switch {
+	case report.DryRun:
+		store = func(ctx context.Context, items []any) error {
+			_, err := diff(ctx, items)
+			return err
+		}
+
+	case len(svc.opts.sinks) > 0:
+		store = svc.publishing(entity, store, diff)
+	}
+
+	store = svc.transforming(entity, store)
+
+	var (
+		stored []string
+		failed []orders.DeadLetter
+	)
+
+	for _, l := range letters {
+		item, err := decode([]byte(l.Payload))
+		if err == nil {
+			l.Stage = "store"
+			err = store(ctx, []any{item})
+		}
+
+		if ctx.Err() != nil {
+			recordError(span, ctx.Err())
+			return nil, ctx.Err()
+		}
+
+		if err != nil {
+			l.Attempts++
+			l.Error = err.Error()
+			l.UpdatedAt = time.Now()
+
+			failed = append(failed, l)
+			continue
+		}
+
+		stored = append(stored, l.ID)
+	}
+
+	report.Stored = len(stored)
+	report.Failed = len(failed)
+
+	span.SetAttributes(
+		attribute.Int("retry.stored", report.Stored),
+		attribute.Int("retry.failed", report.Failed),
+	)
+
+	if report.DryRun {
+		return report, nil
+	}
+
+	if err := svc.orders.StoreDeadLetters(ctx, failed); err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	if len(stored) > 0 {
+		if _, err := svc.orders.DeleteDeadLetters(ctx, orders.DeadLetterFilter{IDs: stored}); err != nil {
+			recordError(span, err)
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+func decodeAs[T any](payload []byte) (any, error) {
+	var record T
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
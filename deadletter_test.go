@@ -0,0 +1,294 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/qdm"
+)
+
+func TestSyncSetsAsideDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	items := append(fakeOrders(30), &qdm.Invalid{
+		Entity: "orders",
+		Raw:    []byte(`{"order_id":"x"}`),
+		Err:    errors.New("cannot unmarshal string into order_id"),
+	})
+
+	repo := &fakeRepository{
+		rejected: map[int]bool{5: true, 17: true},
+	}
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithBatchSize(10),
+		WithWriters(1),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(28), result.Stored)
+	assert.Equal(int64(3), result.Failed)
+	assert.Zero(result.Skipped)
+	assert.Len(repo.orders, 28)
+
+	stages := make(map[int]string)
+	for _, l := range repo.letters {
+		assert.Equal(run.ID(), l.RunID)
+		assert.Equal("orders", l.Entity)
+		stages[l.RecordID] = l.Stage
+	}
+
+	assert.Equal(map[int]string{0: "decode", 5: "store", 17: "store"}, stages)
+
+	// the rejected orders are accepted now, the undecodable one still is not
+	repo.rejected = nil
+
+	retried, err := svc.RetryDeadLetters(context.Background(), "orders")
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(3, retried.Total)
+	assert.Equal(2, retried.Stored)
+	assert.Equal(1, retried.Failed)
+	assert.Len(repo.orders, 30)
+
+	if assert.Len(repo.letters, 1) {
+		for _, l := range repo.letters {
+			assert.Equal("decode", l.Stage)
+			assert.Equal(2, l.Attempts)
+		}
+	}
+}
+
+func TestSyncSetsAsideWholeRejectedBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	rejected := map[int]bool{5: true}
+	for id := 1; id <= 2; id++ {
+		rejected[id] = true
+	}
+
+	repo := &fakeRepository{rejected: rejected}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(5))}, repo,
+		WithBatchSize(2),
+		WithWriters(1),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	// orders 1 and 2 fill a batch, order 5 is alone in the last one
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(2), result.Stored)
+	assert.Equal(int64(3), result.Failed)
+	assert.Len(repo.letters, 3)
+}
+
+func TestSyncFailsWhenStoreFails(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{err: errors.New("connection refused")}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(5))}, repo,
+		WithBatchSize(2),
+		WithWriters(1),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.Error(result.Err)
+	assert.Empty(repo.letters)
+}
+
+func TestSyncSetsAsideUntransformedRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls atomic.Int64
+
+	repo := &fakeRepository{rejected: map[int]bool{3: true}}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(5))}, repo,
+		WithBatchSize(5),
+		WithOrderTransform(func(o *orders.Order) error {
+			calls.Add(1)
+			o.Total += 1
+			return nil
+		}),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+
+	// the stored orders are transformed once, though their batch was retried
+	if assert.Len(repo.orders, 4) {
+		for _, o := range repo.orders {
+			assert.Equal(float64(1), o.Total)
+		}
+	}
+
+	// the batch, then every record once
+	assert.Equal(int64(10), calls.Load())
+
+	if assert.Len(repo.letters, 1) {
+		for _, l := range repo.letters {
+			assert.Contains(l.Payload, `"total":0,`)
+		}
+	}
+
+	repo.rejected = nil
+
+	retried, err := svc.RetryDeadLetters(context.Background(), "orders")
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(1, retried.Stored)
+	if assert.Len(repo.orders, 5) {
+		assert.Equal(float64(1), repo.orders[4].Total)
+	}
+}
+
+func TestSyncRedactsDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	items := []any{&qdm.Invalid{
+		Entity: "orders",
+		Raw:    []byte(`{"order_id":"x","payment_email":"ming@example.com"}`),
+		Err:    errors.New("cannot unmarshal string into order_id"),
+	}}
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithDeadLetterRedaction("orders", func(payload []byte) []byte {
+			return bytes.ReplaceAll(payload, []byte("ming@example.com"), []byte("m**g@example.com"))
+		}),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	run.Wait()
+
+	if assert.Len(repo.letters, 1) {
+		for _, l := range repo.letters {
+			assert.NotContains(l.Payload, "ming@")
+			assert.Contains(l.Payload, "m**g@example.com")
+		}
+	}
+}
+
+func TestRetryDeadLettersWithDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{
+		letters: map[string]orders.DeadLetter{
+			"1": {ID: "1", Entity: "orders", RecordID: 1, Stage: "store", Payload: `{"order_id":1}`, Attempts: 1},
+		},
+	}
+
+	svc := NewService(&fakeQDM{}, repo, WithDryRun(true))
+	defer svc.Close()
+
+	retried, err := svc.RetryDeadLetters(context.Background(), "orders")
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.True(retried.DryRun)
+	assert.Equal(1, retried.Stored)
+	assert.Empty(repo.orders)
+	assert.Len(repo.letters, 1)
+}
+
+func TestSyncSetsAsideRecordsWithUntransformedItems(t *testing.T) {
+	assert := assert.New(t)
+
+	items := make([]any, 3)
+	for i := range items {
+		items[i] = orders.Order{
+			OrderID:    i + 1,
+			OrderItems: []orders.OrderItem{{ProductID: 1, Price: 100}},
+		}
+	}
+	source := slices.Clone(items)
+
+	repo := &fakeRepository{rejected: map[int]bool{2: true}}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithBatchSize(3),
+		WithOrderTransform(func(o *orders.Order) error {
+			o.OrderItems[0].Price += 10
+			return nil
+		}),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+
+	// the items of the stored orders are changed once, though their batch
+	// was retried, and the fetched orders are left as they came
+	if assert.Len(repo.orders, 2) {
+		for _, o := range repo.orders {
+			assert.Equal(110, o.OrderItems[0].Price)
+		}
+	}
+
+	for _, item := range source {
+		assert.Equal(100, item.(orders.Order).OrderItems[0].Price)
+	}
+
+	if assert.Len(repo.letters, 1) {
+		for _, l := range repo.letters {
+			assert.Contains(l.Payload, `"price":100,`)
+		}
+	}
+
+	repo.rejected = nil
+
+	retried, err := svc.RetryDeadLetters(context.Background(), "orders")
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(1, retried.Stored)
+	if assert.Len(repo.orders, 3) {
+		assert.Equal(110, repo.orders[2].OrderItems[0].Price)
+	}
+}
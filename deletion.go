@@ -0,0 +1,223 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/qdm"
+)
+
+// Deletions reports the records stored for a window that QDM no longer has.
+type Deletions struct {
+	Entity string
+	Mode   orders.DeleteMode
+	IDs    []int // 已從 QDM 移除的編號
+	DryRun bool  // 僅列出，未刪除
+
+	// Warnings lists what failed after the records were removed, such as
+	// refreshing the stats of their customers.
+	Warnings []error
+}
+
+// ReconcileDeleted lists the records of a window in QDM and removes the
+// stored ones missing from it, according to the delete mode. Nothing is
+// removed when the listing is incomplete.
+func (svc *service) ReconcileDeleted(ctx context.Context, entity string, start time.Time, end time.Time) (*Deletions, error) {
+	var (
+		find   func(ctx context.Context, start time.Time, end time.Time) (qdm.Iterator, error)
+		count  func(ctx context.Context, start time.Time, end time.Time) (int64, error)
+		stored func(ctx context.Context, start time.Time, end time.Time) ([]int, error)
+		remove func(ctx context.Context, ids []int, mode orders.DeleteMode) error
+		idOf   func(item any) (int, bool)
+	)
+
+	switch entity {
+	case "orders":
+		find = func(ctx context.Context, start time.Time, end time.Time) (qdm.Iterator, error) {
+			return svc.qdm.FindOrders(ctx, start, end)
+		}
+		count = func(ctx context.Context, start time.Time, end time.Time) (int64, error) {
+			return svc.qdm.CountOrders(ctx, start, end)
+		}
+		stored = svc.orders.OrderIDs
+		remove = svc.orders.DeleteOrders
+		idOf = func(item any) (int, bool) {
+			o, ok := item.(orders.Order)
+			return o.OrderID, ok
+		}
+
+	case "customers":
+		find = svc.qdm.FindCustomers
+		count = svc.qdm.CountCustomers
+		stored = svc.orders.CustomerIDs
+		remove = svc.orders.DeleteCustomers
+		idOf = func(item any) (int, bool) {
+			c, ok := item.(orders.Customer)
+			return c.CustomerID, ok
+		}
+
+	default:
+		return nil, errors.New("entity not reconcilable: " + entity)
+	}
+
+	ctx, span := tracer.Start(ctx, "reconcile."+entity,
+		trace.WithAttributes(
+			attribute.String("sync.entity", entity),
+			attribute.String("sync.start", start.Format(time.RFC3339)),
+			attribute.String("sync.end", end.Format(time.RFC3339)),
+		),
+	)
+	defer span.End()
+
+	// a sync of the entity running meanwhile could bring removed records back
+	ctx, release, err := svc.lock(ctx, entity, uuid.NewString())
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	defer release()
+
+	// read the stored IDs first, so records added meanwhile are seen in QDM
+	ids, err := stored(ctx, start, end)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	seen, err := svc.list(ctx, entity, start, end, find, count, idOf)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	report := &Deletions{
+		Entity: entity,
+		Mode:   svc.opts.deleteMode,
+		DryRun: svc.opts.dryRun,
+	}
+
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			report.IDs = append(report.IDs, id)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("sync.deleted", len(report.IDs)))
+
+	if len(report.IDs) == 0 || report.DryRun {
+		return report, nil
+	}
+
+	changes := make([]orders.Change, len(report.IDs))
+	for i, id := range report.IDs {
+		changes[i] = orders.Change{Type: orders.Deleted, ID: id}
+	}
+
+	if err := svc.publish(ctx, entity, changes, nil); err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	// the stats of the customers of removed orders are aggregated again
+	customers := make(map[int]struct{})
+	if svc.opts.customerStats && entity == "orders" {
+		ids, err := svc.orders.OrderCustomerIDs(ctx, report.IDs)
+		if err != nil {
+			recordError(span, err)
+			return nil, err
+		}
+
+		for _, id := range ids {
+			customers[id] = struct{}{}
+		}
+	}
+
+	if err := remove(ctx, report.IDs, report.Mode); err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+
+	svc.log.Info("records deleted",
+		zap.String("action", "reconcile"),
+		zap.String("entity", entity),
+		zap.String("mode", string(report.Mode)),
+		zap.Ints("ids", report.IDs),
+	)
+
+	if len(customers) > 0 {
+		if err := svc.refreshCustomerStats(ctx, customers); err != nil {
+			report.Warnings = append(report.Warnings, err)
+			svc.log.Warn(err.Error(), zap.String("action", "reconcile"))
+		}
+	}
+
+	return report, nil
+}
+
+// list collects the IDs of the records QDM has for a window.
+func (svc *service) list(ctx context.Context, entity string, start time.Time, end time.Time,
+	find func(ctx context.Context, start time.Time, end time.Time) (qdm.Iterator, error),
+	count func(ctx context.Context, start time.Time, end time.Time) (int64, error),
+	idOf func(item any) (int, bool),
+) (map[int]struct{}, error) {
+	seen := make(map[int]struct{})
+
+	it, err := find(ctx, start, end)
+	if err != nil {
+		if !errors.Is(err, qdm.ErrEmptyData) {
+			return nil, err
+		}
+
+		// every stored record of the window goes when it is empty, so a
+		// single count answering none is not taken for granted
+		n, err := count(ctx, start, end)
+		if err != nil {
+			return nil, fmt.Errorf("listing incomplete, nothing deleted: %w", err)
+		}
+
+		if n > 0 {
+			return nil, fmt.Errorf("listing incomplete, nothing deleted: QDM listed no %s, then counted %d", entity, n)
+		}
+
+		return seen, nil
+	}
+	defer it.Close(nil)
+
+	for {
+		items, err := it.Fetch(svc.opts.batchSize)
+		if err != nil {
+			if errors.Is(err, qdm.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		for _, item := range items {
+			if invalid, ok := item.(*qdm.Invalid); ok {
+				return nil, fmt.Errorf("listing incomplete, nothing deleted: %w", invalid)
+			}
+
+			id, ok := idOf(item)
+			if !ok {
+				return nil, errors.New("type assertion failed")
+			}
+
+			seen[id] = struct{}{}
+		}
+	}
+
+	if warning := reconcile(entity, it); warning != nil {
+		return nil, fmt.Errorf("listing incomplete, nothing deleted: %w", warning)
+	}
+
+	return seen, nil
+}
@@ -0,0 +1,156 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/qdm"
+)
+
+func TestReconcileDeleted(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now()
+
+	// orders 3 and 5 were removed in QDM
+	newRepo := func() *fakeRepository {
+		repo := &fakeRepository{}
+		for _, item := range fakeOrders(6) {
+			order := item.(orders.Order)
+			order.DateAdded = orders.QDMTime(start.Add(time.Minute))
+			repo.orders = append(repo.orders, order)
+		}
+
+		return repo
+	}
+
+	newQDM := func() *fakeQDM {
+		var items []any
+		for _, item := range fakeOrders(6) {
+			if id := item.(orders.Order).OrderID; id != 3 && id != 5 {
+				items = append(items, item)
+			}
+		}
+
+		return &fakeQDM{orders: newFakeIterator(items)}
+	}
+
+	// soft deletes by default
+	repo := newRepo()
+	svc := NewService(newQDM(), repo)
+	defer svc.Close()
+
+	report, err := svc.ReconcileDeleted(context.Background(), "orders", start, end)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(orders.SoftDelete, report.Mode)
+	assert.Equal([]int{3, 5}, report.IDs)
+	assert.Len(repo.orders, 6)
+	assert.True(repo.deleted[3])
+	assert.True(repo.deleted[5])
+
+	// hard deletes
+	repo = newRepo()
+	svc = NewService(newQDM(), repo, WithDeleteMode(orders.HardDelete))
+	defer svc.Close()
+
+	report, err = svc.ReconcileDeleted(context.Background(), "orders", start, end)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]int{3, 5}, report.IDs)
+	assert.Len(repo.orders, 4)
+
+	// only reports in a dry run
+	repo = newRepo()
+	svc = NewService(newQDM(), repo, WithDryRun(true))
+	defer svc.Close()
+
+	report, err = svc.ReconcileDeleted(context.Background(), "orders", start, end)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.True(report.DryRun)
+	assert.Equal([]int{3, 5}, report.IDs)
+	assert.Len(repo.orders, 6)
+	assert.Empty(repo.deleted)
+}
+
+func TestReconcileDeletedWithIncompleteListing(t *testing.T) {
+	assert := assert.New(t)
+
+	it := newFakeIterator(fakeOrders(4))
+	it.expected = 6
+
+	repo := &fakeRepository{}
+	for _, item := range fakeOrders(6) {
+		repo.orders = append(repo.orders, item.(orders.Order))
+	}
+
+	svc := NewService(&fakeQDM{orders: it}, repo)
+	defer svc.Close()
+
+	_, err := svc.ReconcileDeleted(context.Background(), "orders", time.Time{}, time.Now())
+
+	var mismatch *CountMismatch
+	assert.ErrorAs(err, &mismatch)
+	assert.Empty(repo.deleted)
+}
+
+// emptyListingQDM lists no orders, though it counts them when asked again.
+type emptyListingQDM struct {
+	*fakeQDM
+}
+
+func (q emptyListingQDM) FindOrders(ctx context.Context, start time.Time, end time.Time, opts ...qdm.OrderOption) (qdm.Iterator, error) {
+	return nil, qdm.ErrEmptyData
+}
+
+func TestReconcileDeletedWithEmptyListing(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now()
+
+	var items []any
+	for _, item := range fakeOrders(4) {
+		order := item.(orders.Order)
+		order.DateAdded = orders.QDMTime(start.Add(time.Minute))
+		items = append(items, order)
+	}
+
+	repo := &fakeRepository{}
+	for _, item := range items {
+		repo.orders = append(repo.orders, item.(orders.Order))
+	}
+
+	svc := NewService(emptyListingQDM{&fakeQDM{orders: newFakeIterator(items)}}, repo,
+		WithDeleteMode(orders.HardDelete),
+	)
+	defer svc.Close()
+
+	_, err := svc.ReconcileDeleted(context.Background(), "orders", start, end)
+	assert.ErrorContains(err, "listing incomplete, nothing deleted: QDM listed no orders, then counted 4")
+	assert.Len(repo.orders, 4)
+
+	// the window is emptied once it is counted empty again
+	svc = NewService(emptyListingQDM{&fakeQDM{orders: newFakeIterator(nil)}}, repo,
+		WithDeleteMode(orders.HardDelete),
+	)
+	defer svc.Close()
+
+	report, err := svc.ReconcileDeleted(context.Background(), "orders", start, end)
+	if assert.NoError(err) {
+		assert.Equal([]int{1, 2, 3, 4}, report.IDs)
+	}
+	assert.Empty(repo.orders)
+}
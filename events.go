@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// Event tells downstream services that a record was created, updated or
+// deleted by a sync.
+type Event struct {
+	Type   orders.ChangeType `json:"type"`             // created, updated or deleted
+	Entity string            `json:"entity"`           // orders, customers or customer_groups
+	ID     int               `json:"id"`               // 訂單、會員或會員群組編號
+	Fields []string          `json:"fields,omitempty"` // 異動的欄位 (僅 updated)
+	Record any               `json:"record,omitempty"` // 資料內容，設定了對應時為對應後的文件 (deleted 時為空)
+	Time   time.Time         `json:"time"`
+}
+
+// EventSink receives the events of a sync. Events are published before the
+// records are stored, so a batch that fails to store is published again by
+// the next run: delivery is at least once.
+type EventSink interface {
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// publish sends the events of the changed records to every sink.
+func (svc *service) publish(ctx context.Context, entity string, changes []orders.Change, records []any) error {
+	if len(svc.opts.sinks) == 0 {
+		return nil
+	}
+
+	if records != nil && len(changes) != len(records) {
+		return errors.New("changes do not match records")
+	}
+
+	now := time.Now()
+
+	events := make([]Event, 0, len(changes))
+	for i, c := range changes {
+		if c.Type == orders.Unchanged {
+			continue
+		}
+
+		e := Event{
+			Type:   c.Type,
+			Entity: entity,
+			ID:     c.ID,
+			Fields: c.Fields,
+			Time:   now,
+		}
+
+		// the document as mapped for storage, when mappings are configured
+		switch {
+		case c.Document != nil:
+			e.Record = c.Document
+
+		case records != nil:
+			e.Record = records[i]
+		}
+
+		events = append(events, e)
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, sink := range svc.opts.sinks {
+		if err := sink.Publish(ctx, events); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// publishing stores the items after publishing the events of their changes.
+func (svc *service) publishing(entity string, store storeFunc, diff diffFunc) storeFunc {
+	return func(ctx context.Context, items []any) error {
+		changes, err := diff(ctx, items)
+		if err != nil {
+			return err
+		}
+
+		if err := svc.publish(ctx, entity, changes, items); err != nil {
+			return err
+		}
+
+		return store(ctx, items)
+	}
+}
@@ -0,0 +1,163 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+type fakeSink struct {
+	mu     stdsync.Mutex
+	events []Event
+	err    error
+}
+
+func (sink *fakeSink) Publish(ctx context.Context, events []Event) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if sink.err != nil {
+		return sink.err
+	}
+
+	sink.events = append(sink.events, events...)
+	return nil
+}
+
+func (sink *fakeSink) Close() error {
+	return nil
+}
+
+func (sink *fakeSink) count(t orders.ChangeType) int {
+	n := 0
+	for _, e := range sink.events {
+		if e.Type == t {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestSyncOrdersWithEventSink(t *testing.T) {
+	assert := assert.New(t)
+
+	items := fakeOrders(30)
+
+	// 10 unchanged, 10 updated, 10 created
+	repo := &fakeRepository{}
+	for i, item := range items[:20] {
+		order := item.(orders.Order)
+		if i >= 10 {
+			order.OrderStatus = 2
+		}
+
+		repo.orders = append(repo.orders, order)
+	}
+
+	sink := &fakeSink{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithBatchSize(8),
+		WithEventSink(sink),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(30), result.Stored)
+
+	assert.Len(sink.events, 20)
+	assert.Equal(10, sink.count(orders.Created))
+	assert.Equal(10, sink.count(orders.Updated))
+
+	for _, e := range sink.events {
+		order, ok := e.Record.(orders.Order)
+		if assert.True(ok) {
+			assert.Equal(e.ID, order.OrderID)
+		}
+	}
+}
+
+func TestPublishMappedDocuments(t *testing.T) {
+	assert := assert.New(t)
+
+	sink := &fakeSink{}
+	svc := NewService(&fakeQDM{}, &fakeRepository{}, WithEventSink(sink)).(*service)
+	defer svc.Close()
+
+	changes := []orders.Change{
+		{Type: orders.Created, ID: 1, Document: map[string]any{"order_id": 1}},
+		{Type: orders.Created, ID: 2},
+	}
+
+	records := []any{
+		orders.Order{OrderID: 1, CustomerUserAgent: "Mozilla/5.0"},
+		orders.Order{OrderID: 2},
+	}
+
+	if !assert.NoError(svc.publish(context.Background(), "orders", changes, records)) {
+		return
+	}
+
+	if assert.Len(sink.events, 2) {
+		assert.Equal(map[string]any{"order_id": 1}, sink.events[0].Record)
+		assert.Equal(records[1], sink.events[1].Record)
+	}
+}
+
+func TestSyncOrdersWithFailingEventSink(t *testing.T) {
+	assert := assert.New(t)
+
+	sinkErr := errors.New("sink unavailable")
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(10))}, repo,
+		WithEventSink(&fakeSink{err: sinkErr}),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	// not stored, so the next run publishes them again
+	result := run.Wait()
+	assert.ErrorIs(result.Err, sinkErr)
+	assert.Empty(repo.orders)
+}
+
+func TestReconcileDeletedWithEventSink(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{}
+	for _, item := range fakeOrders(3) {
+		repo.orders = append(repo.orders, item.(orders.Order))
+	}
+
+	sink := &fakeSink{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(2))}, repo,
+		WithEventSink(sink),
+	)
+	defer svc.Close()
+
+	_, err := svc.ReconcileDeleted(context.Background(), "orders", time.Time{}, time.Now())
+	if !assert.NoError(err) || !assert.Len(sink.events, 1) {
+		return
+	}
+
+	assert.Equal(orders.Deleted, sink.events[0].Type)
+	assert.Equal(3, sink.events[0].ID)
+	assert.Nil(sink.events[0].Record)
+}
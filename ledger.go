@@ -0,0 +1,110 @@
+package sync
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/qdm"
+)
+
+// start opens the span of a run, locks its entity and records it as running
+// in the ledger. The returned context counts the QDM API calls of the run.
+func (svc *service) start(ctx context.Context, entity string, start time.Time, end time.Time) (context.Context, *Run, trace.Span, error) {
+	ctx, span := startSpan(ctx, entity, start, end)
+
+	run := newRun(entity, 0)
+	run.window = [2]time.Time{start, end}
+
+	ctx, release, err := svc.lock(ctx, entity, run.id)
+	if err != nil {
+		recordError(span, err)
+		span.End()
+		return nil, nil, nil, err
+	}
+
+	run.release = release
+
+	ctx = qdm.CountCalls(ctx, &run.calls)
+	svc.record(ctx, run, nil)
+
+	return ctx, run, span, nil
+}
+
+// finish records the outcome of the run in the ledger and releases its lock
+// before handing the result to its waiters.
+func (svc *service) finish(ctx context.Context, run *Run, result Result) {
+	result = run.complete(result)
+	svc.record(ctx, run, &result)
+	run.release()
+	run.finish(result)
+}
+
+// record writes the ledger entry of the run, still running when result is
+// nil. A ledger that cannot be written only warns: it must not fail a sync.
+func (svc *service) record(ctx context.Context, run *Run, result *Result) {
+	entry := orders.SyncRun{
+		ID:        run.id,
+		Entity:    run.entity,
+		Start:     run.window[0],
+		End:       run.window[1],
+		BatchSize: svc.opts.batchSize,
+		Writers:   svc.opts.writers,
+		Throttle:  svc.opts.throttle,
+		DryRun:    svc.opts.dryRun,
+		StartedAt: run.started,
+		APICalls:  run.calls.Load(),
+		Outcome:   orders.RunRunning,
+	}
+
+	if result != nil {
+		entry.FinishedAt = run.started.Add(result.Duration)
+		entry.Stored = result.Stored
+		entry.Created = result.Created
+		entry.Updated = result.Updated
+		entry.Unchanged = result.Unchanged
+		entry.Skipped = result.Skipped
+		entry.Failed = result.Failed
+		entry.APICalls = result.APICalls
+		entry.Violations = len(result.Violations)
+		entry.Outcome = orders.RunSucceeded
+
+		if result.Err != nil {
+			entry.Outcome = orders.RunFailed
+			entry.Error = result.Err.Error()
+		}
+
+		for _, w := range result.Warnings {
+			entry.Warnings = append(entry.Warnings, w.Error())
+		}
+	}
+
+	// the run may have been canceled, its ledger entry is still due
+	if err := svc.orders.RecordRun(context.WithoutCancel(ctx), entry); err != nil {
+		svc.log.Warn("run not recorded",
+			zap.String("action", "record_run"),
+			zap.String("run", run.id),
+			zap.String("entity", run.entity),
+			zap.Error(err),
+		)
+	}
+}
+
+func startSpan(ctx context.Context, entity string, start time.Time, end time.Time) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("sync.entity", entity),
+	}
+
+	if !start.IsZero() {
+		attrs = append(attrs,
+			attribute.String("sync.start", start.Format(time.RFC3339)),
+			attribute.String("sync.end", end.Format(time.RFC3339)),
+		)
+	}
+
+	return tracer.Start(ctx, "sync."+entity, trace.WithAttributes(attrs...))
+}
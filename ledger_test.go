@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestSyncRecordsRuns(t *testing.T) {
+	assert := assert.New(t)
+
+	end := time.Now().Truncate(time.Second)
+	start := end.Add(-time.Hour)
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(250))}, repo,
+		WithBatchSize(100),
+		WithWriters(1),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), start, end)
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.Equal(run.ID(), result.ID)
+
+	if !assert.Len(repo.runs, 2) {
+		return
+	}
+
+	running, finished := repo.runs[0], repo.runs[1]
+	assert.Equal(run.ID(), running.ID)
+	assert.Equal(orders.RunRunning, running.Outcome)
+	assert.True(running.FinishedAt.IsZero())
+
+	assert.Equal(run.ID(), finished.ID)
+	assert.Equal("orders", finished.Entity)
+	assert.Equal(start, finished.Start)
+	assert.Equal(end, finished.End)
+	assert.Equal(100, finished.BatchSize)
+	assert.Equal(1, finished.Writers)
+	assert.Equal(orders.RunSucceeded, finished.Outcome)
+	assert.Equal(int64(250), finished.Stored)
+	assert.False(finished.FinishedAt.Before(finished.StartedAt))
+}
+
+func TestSyncRecordsFailedRuns(t *testing.T) {
+	assert := assert.New(t)
+
+	storeErr := errors.New("store failed")
+
+	repo := &fakeRepository{err: storeErr}
+	svc := NewService(&fakeQDM{groups: []orders.CustomerGroup{{}}}, repo)
+	defer svc.Close()
+
+	run, err := svc.SyncCustomerGroups(context.Background())
+	if !assert.NoError(err) {
+		return
+	}
+
+	run.Wait()
+
+	if assert.Len(repo.runs, 2) {
+		finished := repo.runs[1]
+		assert.Equal("customer_groups", finished.Entity)
+		assert.True(finished.Start.IsZero())
+		assert.Equal(orders.RunFailed, finished.Outcome)
+		assert.Equal(storeErr.Error(), finished.Error)
+		assert.Equal(int64(1), finished.Failed)
+	}
+}
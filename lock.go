@@ -0,0 +1,80 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// ErrLockLost fails a sync whose lock could not be renewed, as another run
+// may be writing the same records by now.
+var ErrLockLost = errors.New("lock lost")
+
+// lockRetry is how often a waiting sync tries to acquire the lock again.
+var lockRetry = 5 * time.Second
+
+// lock acquires the lock of the entity for owner, waiting for it if
+// configured. The returned context is canceled with ErrLockLost when the
+// lease is lost and release gives the lock back. Dry runs write nothing and
+// take no lock.
+func (svc *service) lock(ctx context.Context, entity string, owner string) (context.Context, func(), error) {
+	if svc.opts.dryRun {
+		return ctx, func() {}, nil
+	}
+
+	log := svc.log.With(
+		zap.String("action", "lock"),
+		zap.String("entity", entity),
+		zap.String("owner", owner),
+	)
+
+	var lease orders.Lease
+	for {
+		var err error
+		lease, err = svc.orders.Lock(ctx, "sync."+entity, owner, svc.opts.lockTTL, svc.opts.forceLock)
+		if err == nil {
+			break
+		}
+
+		var held *orders.LockHeld
+		if !errors.As(err, &held) || !svc.opts.lockWait {
+			return nil, nil, err
+		}
+
+		log.Info("waiting for lock", zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(lockRetry):
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	released := make(chan struct{})
+	go func() {
+		select {
+		case <-lease.Lost():
+			log.Error(ErrLockLost.Error())
+			cancel(ErrLockLost)
+
+		case <-released:
+		}
+	}()
+
+	release := func() {
+		close(released)
+		cancel(nil)
+
+		if err := lease.Release(context.WithoutCancel(ctx)); err != nil {
+			log.Warn("lock not released", zap.Error(err))
+		}
+	}
+
+	return ctx, release, nil
+}
@@ -0,0 +1,126 @@
+package sync
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestSyncReleasesLock(t *testing.T) {
+	assert := assert.New(t)
+
+	// checked while the run works, which may finish before SyncOrders
+	// returns
+	var held atomic.Bool
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(10))}, repo,
+		WithOrderTransform(func(o *orders.Order) error {
+			if o.OrderID == 1 {
+				held.Store(repo.locked("sync.orders"))
+			}
+
+			return nil
+		}),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.True(held.Load())
+	assert.False(repo.locked("sync.orders"))
+}
+
+func TestSyncWithLockHeld(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{}
+	if _, err := repo.Lock(context.Background(), "sync.orders", "other", time.Minute, false); !assert.NoError(err) {
+		return
+	}
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(10))}, repo)
+	defer svc.Close()
+
+	_, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+
+	var held *orders.LockHeld
+	if assert.ErrorAs(err, &held) {
+		assert.Equal("other", held.Lock.Owner)
+	}
+
+	assert.Empty(repo.orders)
+	assert.Empty(repo.runs)
+}
+
+func TestSyncWithLockWait(t *testing.T) {
+	assert := assert.New(t)
+
+	retry := lockRetry
+	lockRetry = 10 * time.Millisecond
+	defer func() { lockRetry = retry }()
+
+	repo := &fakeRepository{}
+	lease, err := repo.Lock(context.Background(), "sync.orders", "other", time.Minute, false)
+	if !assert.NoError(err) {
+		return
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() {
+		lease.Release(context.Background())
+	})
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(10))}, repo,
+		WithLockWait(true),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(10), result.Stored)
+}
+
+func TestSyncWithForceLock(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{}
+	lease, err := repo.Lock(context.Background(), "sync.orders", "other", time.Minute, false)
+	if !assert.NoError(err) {
+		return
+	}
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(10))}, repo,
+		WithForceLock(true),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(10), result.Stored)
+
+	select {
+	case <-lease.Lost():
+	default:
+		assert.Fail("lease of the other run not lost")
+	}
+}
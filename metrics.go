@@ -0,0 +1,44 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	batchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "sync",
+		Name:      "batches_total",
+		Help:      "Total number of batches processed by entity and status.",
+	}, []string{"entity", "status"})
+
+	recordsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "sync",
+		Name:      "records_total",
+		Help:      "Total number of records synchronized by entity.",
+	}, []string{"entity"})
+
+	batchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "sync",
+		Name:      "batch_duration_seconds",
+		Help:      "Time spent storing a batch by entity.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"entity"})
+)
+
+func observeBatch(entity string, size int, start time.Time, err error) {
+	batchDuration.WithLabelValues(entity).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		batchesTotal.WithLabelValues(entity, "error").Inc()
+		return
+	}
+
+	batchesTotal.WithLabelValues(entity, "ok").Inc()
+	recordsTotal.WithLabelValues(entity).Add(float64(size))
+}
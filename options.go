@@ -0,0 +1,230 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/validation"
+)
+
+type options struct {
+	batchSize     int                            // 每批寫入筆數
+	writers       int                            // 同時寫入的 worker 數
+	throttle      time.Duration                  // 兩批之間的最短間隔 (0=不限制)
+	dryRun        bool                           // 只比對差異，不寫入
+	changedOnly   bool                           // 只寫入新增或異動的資料
+	deleteMode    orders.DeleteMode              // QDM 已移除資料的刪除方式
+	sinks         []EventSink                    // 異動事件的接收端
+	lockTTL       time.Duration                  // 鎖定租約長度
+	lockWait      bool                           // 等待其他執行釋放鎖定
+	forceLock     bool                           // 強制取得其他執行持有的鎖定
+	validator     *validation.Engine             // 驗證規則 (nil=內建規則)
+	validate      bool                           // 同步時驗證資料
+	customerStats bool                           // 同步訂單後更新會員統計
+	redactions    map[string]func([]byte) []byte // 死信內容的遮蔽 (依資料類型)
+
+	orderTransforms    []func(*orders.Order) error         // 訂單寫入前的轉換
+	customerTransforms []func(*orders.Customer) error      // 會員寫入前的轉換
+	groupTransforms    []func(*orders.CustomerGroup) error // 會員群組寫入前的轉換
+}
+
+func defaultOptions() options {
+	return options{
+		batchSize:  100,
+		writers:    2,
+		deleteMode: orders.SoftDelete,
+		lockTTL:    time.Minute,
+	}
+}
+
+type Option interface {
+	apply(*options)
+}
+
+func WithBatchSize(size int) Option {
+	return batchSizeOption(size)
+}
+
+type batchSizeOption int
+
+func (opt batchSizeOption) apply(o *options) {
+	if opt > 0 {
+		o.batchSize = int(opt)
+	}
+}
+
+func WithWriters(n int) Option {
+	return writersOption(n)
+}
+
+type writersOption int
+
+func (opt writersOption) apply(o *options) {
+	if opt > 0 {
+		o.writers = int(opt)
+	}
+}
+
+func WithThrottle(interval time.Duration) Option {
+	return throttleOption(interval)
+}
+
+type throttleOption time.Duration
+
+func (opt throttleOption) apply(o *options) {
+	o.throttle = time.Duration(opt)
+}
+
+// WithDryRun compares the fetched records with the repository instead of
+// storing them.
+func WithDryRun(enabled bool) Option {
+	return dryRunOption(enabled)
+}
+
+type dryRunOption bool
+
+func (opt dryRunOption) apply(o *options) {
+	o.dryRun = bool(opt)
+}
+
+// WithChangedOnly stores only the records that are new or differ from the
+// stored ones, e.g. when re-syncing a window already synced.
+func WithChangedOnly(enabled bool) Option {
+	return changedOnlyOption(enabled)
+}
+
+type changedOnlyOption bool
+
+func (opt changedOnlyOption) apply(o *options) {
+	o.changedOnly = bool(opt)
+}
+
+// WithDeleteMode sets how records removed in QDM are removed from the
+// repository, soft deleting them by default.
+func WithDeleteMode(mode orders.DeleteMode) Option {
+	return deleteModeOption(mode)
+}
+
+type deleteModeOption orders.DeleteMode
+
+func (opt deleteModeOption) apply(o *options) {
+	if opt != "" {
+		o.deleteMode = orders.DeleteMode(opt)
+	}
+}
+
+// WithEventSink publishes the changes of every sync to the sink; it can be
+// given several times.
+func WithEventSink(sink EventSink) Option {
+	return sinkOption{sink}
+}
+
+type sinkOption struct {
+	sink EventSink
+}
+
+func (opt sinkOption) apply(o *options) {
+	if opt.sink != nil {
+		o.sinks = append(o.sinks, opt.sink)
+	}
+}
+
+// WithLockTTL sets the lease of the lock a sync holds on its entity, renewed
+// while the sync runs; a crashed sync holds the lock at most this long.
+func WithLockTTL(ttl time.Duration) Option {
+	return lockTTLOption(ttl)
+}
+
+type lockTTLOption time.Duration
+
+func (opt lockTTLOption) apply(o *options) {
+	if opt > 0 {
+		o.lockTTL = time.Duration(opt)
+	}
+}
+
+// WithLockWait makes a sync wait for the lock another run holds instead of
+// failing.
+func WithLockWait(enabled bool) Option {
+	return lockWaitOption(enabled)
+}
+
+type lockWaitOption bool
+
+func (opt lockWaitOption) apply(o *options) {
+	o.lockWait = bool(opt)
+}
+
+// WithForceLock makes a sync take over the lock another run holds, e.g. one
+// left behind by a crashed run.
+func WithForceLock(enabled bool) Option {
+	return forceLockOption(enabled)
+}
+
+type forceLockOption bool
+
+func (opt forceLockOption) apply(o *options) {
+	o.forceLock = bool(opt)
+}
+
+// WithValidator sets the rules records are validated against, the built-in
+// rules by default.
+func WithValidator(engine *validation.Engine) Option {
+	return validatorOption{engine}
+}
+
+type validatorOption struct {
+	engine *validation.Engine
+}
+
+func (opt validatorOption) apply(o *options) {
+	o.validator = opt.engine
+}
+
+// WithValidation validates the records of every sync, reporting the
+// violations in the result without rejecting the records.
+func WithValidation(enabled bool) Option {
+	return validationOption(enabled)
+}
+
+type validationOption bool
+
+func (opt validationOption) apply(o *options) {
+	o.validate = bool(opt)
+}
+
+// WithCustomerStats refreshes the customer_stats of the customers whose
+// orders a sync stored, once the sync is done.
+func WithCustomerStats(enabled bool) Option {
+	return customerStatsOption(enabled)
+}
+
+type customerStatsOption bool
+
+func (opt customerStatsOption) apply(o *options) {
+	o.customerStats = bool(opt)
+}
+
+// WithDeadLetterRedaction redacts the JSON payloads of the dead letters of the
+// entity before they are stored, e.g. with the personal data policy, since
+// the payloads are kept as they came from QDM.
+func WithDeadLetterRedaction(entity string, redact func(payload []byte) []byte) Option {
+	return redactionOption{entity, redact}
+}
+
+type redactionOption struct {
+	entity string
+	redact func([]byte) []byte
+}
+
+func (opt redactionOption) apply(o *options) {
+	if opt.redact == nil {
+		return
+	}
+
+	if o.redactions == nil {
+		o.redactions = make(map[string]func([]byte) []byte)
+	}
+
+	o.redactions[opt.entity] = opt.redact
+}
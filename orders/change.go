@@ -0,0 +1,38 @@
+package orders
+
+import "errors"
+
+type ChangeType string
+
+const (
+	Created   ChangeType = "created"
+	Updated   ChangeType = "updated"
+	Unchanged ChangeType = "unchanged"
+	Deleted   ChangeType = "deleted"
+)
+
+// Change describes how storing a record would alter the repository.
+type Change struct {
+	Type     ChangeType
+	ID       int      // 訂單、會員或會員群組編號
+	Fields   []string // 異動的欄位 (僅 Updated)
+	Document any      // 依設定的對應轉換後儲存的文件 (未設定對應時為空)
+}
+
+// DeleteMode decides how records removed in QDM are removed from the
+// repository.
+type DeleteMode string
+
+const (
+	SoftDelete DeleteMode = "soft" // 保留資料並標記 deleted_at
+	HardDelete DeleteMode = "hard" // 直接刪除資料
+)
+
+func (m DeleteMode) Validate() error {
+	switch m {
+	case SoftDelete, HardDelete:
+		return nil
+	}
+
+	return errors.New("invalid delete mode: " + string(m))
+}
@@ -0,0 +1,34 @@
+package orders
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrRejected marks the failures of records the repository refuses to store,
+// e.g. breaking a unique index or a mapping, as opposed to failures of the
+// repository itself; such records can be set aside and the sync go on.
+var ErrRejected = errors.New("record rejected")
+
+// DeadLetter is a record set aside because it could not be decoded or
+// stored, kept with its payload so that it can be retried.
+type DeadLetter struct {
+	ID        string    `json:"id" bson:"_id"`                // 編號
+	RunID     string    `json:"run_id" bson:"run_id"`         // 發生的執行編號
+	Entity    string    `json:"entity" bson:"entity"`         // orders 或 customers
+	RecordID  int       `json:"record_id" bson:"record_id"`   // 資料編號 (無法解析時為 0)
+	Stage     string    `json:"stage" bson:"stage"`           // decode 或 store
+	Payload   string    `json:"payload" bson:"payload"`       // 轉換前的 JSON (依個資政策遮蔽)
+	Error     string    `json:"error" bson:"error"`           // 失敗原因
+	Attempts  int       `json:"attempts" bson:"attempts"`     // 嘗試次數
+	CreatedAt time.Time `json:"created_at" bson:"created_at"` // 建立時間
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"` // 最後嘗試時間
+}
+
+// DeadLetterFilter selects dead letters; empty fields match every letter.
+type DeadLetterFilter struct {
+	Entity string
+	RunID  string
+	IDs    []string
+	Limit  int // 0 為不限制
+}
@@ -0,0 +1,27 @@
+package orders
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// OrderVersion is a snapshot of an order taken whenever a sync stores it new
+// or changed.
+type OrderVersion struct {
+	OrderID      int           `json:"order_id" bson:"order_id"`           // 訂單編號
+	Version      int           `json:"version" bson:"version"`             // 版本 (從 1 起算)
+	RecordedAt   time.Time     `json:"recorded_at" bson:"recorded_at"`     // 記錄時間
+	DateModified QDMTime       `json:"date_modified" bson:"date_modified"` // 訂單最近修改時間
+	Hash         string        `json:"hash" bson:"hash"`                   // 快照內容的 SHA-256
+	Changes      []FieldChange `json:"changes" bson:"changes"`             // 與前一版相異的欄位 (首版為空)
+	Snapshot     bson.Raw      `json:"snapshot" bson:"snapshot"`           // 儲存的訂單文件快照
+}
+
+// FieldChange is a top-level field of an order that differs from the
+// previously stored order.
+type FieldChange struct {
+	Field string        `json:"field" bson:"field"` // 欄位名稱
+	Old   bson.RawValue `json:"old" bson:"old"`     // 前一版的值
+	New   bson.RawValue `json:"new" bson:"new"`     // 此版的值
+}
@@ -0,0 +1,36 @@
+package orders
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Lock is the lease of a lock, renewed by its owner until released.
+type Lock struct {
+	Name       string    `json:"name" bson:"_id"`                // 鎖定名稱 (如 sync.orders)
+	Owner      string    `json:"owner" bson:"owner"`             // 持有者 (執行編號)
+	Host       string    `json:"host" bson:"host"`               // 持有者主機
+	AcquiredAt time.Time `json:"acquired_at" bson:"acquired_at"` // 取得時間
+	ExpiresAt  time.Time `json:"expires_at" bson:"expires_at"`   // 租約到期時間
+}
+
+// LockHeld is returned when another owner holds an unexpired lease.
+type LockHeld struct {
+	Lock Lock
+}
+
+func (e *LockHeld) Error() string {
+	return fmt.Sprintf("%s is locked by run %s on %s since %s (lease expires %s)",
+		e.Lock.Name, e.Lock.Owner, e.Lock.Host,
+		e.Lock.AcquiredAt.Local().Format(time.DateTime),
+		e.Lock.ExpiresAt.Local().Format(time.DateTime))
+}
+
+// Lease is a lock held by its owner. Its heartbeat renews it until it is
+// released, or lost when it could not be renewed before expiring or another
+// owner forced it.
+type Lease interface {
+	Lost() <-chan struct{}
+	Release(ctx context.Context) error
+}
@@ -25,11 +25,28 @@ func (t *QDMTime) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// MarshalJSON writes the time in the layout of the QDM API, so records
+// published as JSON decode back the same way.
+func (t QDMTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).Format("2006-01-02T15:04:05"))
+}
+
 func (t QDMTime) MarshalBSONValue() (bsontype.Type, []byte, error) {
 	dt := time.Time(t)
 	return bson.MarshalValue(dt)
 }
 
+func (t *QDMTime) UnmarshalBSONValue(typ bsontype.Type, data []byte) error {
+	var dt time.Time
+	if err := (bson.RawValue{Type: typ, Value: data}).Unmarshal(&dt); err != nil {
+		return err
+	}
+
+	*t = QDMTime(dt.Local())
+
+	return nil
+}
+
 type Order struct {
 	OrderID                int                `json:"order_id" bson:"order_id"`                                 // 訂單編號
 	BuyButtonID            string             `json:"bb_id" bson:"bb_id"`                                       // Buy Button 專屬編號
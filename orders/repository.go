@@ -1,8 +1,67 @@
 package orders
 
+import (
+	"context"
+	"time"
+)
+
 type Repository interface {
-	Store(orders []Order) error
-	StoreCustomers(customers []Customer) error
-	StoreCustomerGroups(groups []CustomerGroup) error
+	Store(ctx context.Context, orders []Order) error
+	StoreCustomers(ctx context.Context, customers []Customer) error
+	StoreCustomerGroups(ctx context.Context, groups []CustomerGroup) error
+
+	// Diff compares records with the stored ones without writing anything,
+	// returning one change per record in the same order.
+	Diff(ctx context.Context, orders []Order) ([]Change, error)
+	DiffCustomers(ctx context.Context, customers []Customer) ([]Change, error)
+	DiffCustomerGroups(ctx context.Context, groups []CustomerGroup) ([]Change, error)
+
+	// CountOrders and CountCustomers count the stored records added within
+	// [start, end].
+	CountOrders(ctx context.Context, start time.Time, end time.Time) (int64, error)
+	CountCustomers(ctx context.Context, start time.Time, end time.Time) (int64, error)
+
+	// OrderIDs and CustomerIDs list the IDs of the records added within
+	// [start, end] that are not deleted.
+	OrderIDs(ctx context.Context, start time.Time, end time.Time) ([]int, error)
+	CustomerIDs(ctx context.Context, start time.Time, end time.Time) ([]int, error)
+
+	// OrderCustomerIDs lists the customers of the given orders, guests left
+	// out.
+	OrderCustomerIDs(ctx context.Context, ids []int) ([]int, error)
+
+	DeleteOrders(ctx context.Context, ids []int, mode DeleteMode) error
+	DeleteCustomers(ctx context.Context, ids []int, mode DeleteMode) error
+
+	// OrderHistory lists the recorded versions of an order, oldest first.
+	OrderHistory(ctx context.Context, id int) ([]OrderVersion, error)
+
+	// RecordRun writes the ledger entry of a run, replacing the previous
+	// entry with the same ID.
+	RecordRun(ctx context.Context, run SyncRun) error
+
+	// SyncRuns lists the latest runs first, of every entity when entity is
+	// empty; SyncRun returns ErrRunNotFound for an unknown ID.
+	SyncRuns(ctx context.Context, entity string, limit int) ([]SyncRun, error)
+	SyncRun(ctx context.Context, id string) (SyncRun, error)
+
+	// AggregateCustomerStats recomputes the customer_stats of the given
+	// customers, or of every customer when ids is nil, from the stored
+	// orders and returns how many customers have stats. Customers left
+	// without orders lose their stats.
+	AggregateCustomerStats(ctx context.Context, ids []int) (int64, error)
+	CustomerStats(ctx context.Context, ids []int) ([]CustomerStats, error)
+
+	// StoreDeadLetters writes the dead letters, replacing the ones with the
+	// same ID; DeleteDeadLetters returns how many it removed.
+	StoreDeadLetters(ctx context.Context, letters []DeadLetter) error
+	DeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error)
+	DeleteDeadLetters(ctx context.Context, filter DeadLetterFilter) (int64, error)
+
+	// Lock acquires the lock of name for owner with a lease of ttl. It
+	// fails with *LockHeld while another owner holds an unexpired lease,
+	// unless force takes the lock over.
+	Lock(ctx context.Context, name string, owner string, ttl time.Duration, force bool) (Lease, error)
+
 	Disconnected() error
 }
@@ -0,0 +1,42 @@
+package orders
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrRunNotFound = errors.New("run not found")
+
+type RunOutcome string
+
+const (
+	RunRunning   RunOutcome = "running"
+	RunSucceeded RunOutcome = "succeeded"
+	RunFailed    RunOutcome = "failed"
+)
+
+// SyncRun is the ledger entry of a sync run, written when the run starts and
+// again when it finishes.
+type SyncRun struct {
+	ID         string        `json:"id" bson:"_id"`                  // 執行編號
+	Entity     string        `json:"entity" bson:"entity"`           // orders, customers 或 customer_groups
+	Start      time.Time     `json:"start" bson:"start"`             // 同步區間起 (customer_groups 為空)
+	End        time.Time     `json:"end" bson:"end"`                 // 同步區間迄 (customer_groups 為空)
+	BatchSize  int           `json:"batch_size" bson:"batch_size"`   // 每批寫入筆數
+	Writers    int           `json:"writers" bson:"writers"`         // 同時寫入的 worker 數
+	Throttle   time.Duration `json:"throttle" bson:"throttle"`       // 兩批之間的最短間隔
+	DryRun     bool          `json:"dry_run" bson:"dry_run"`         // 只比對差異，不寫入
+	StartedAt  time.Time     `json:"started_at" bson:"started_at"`   // 開始時間
+	FinishedAt time.Time     `json:"finished_at" bson:"finished_at"` // 結束時間 (執行中為空)
+	Stored     int64         `json:"stored" bson:"stored"`           // 寫入筆數
+	Created    int64         `json:"created" bson:"created"`         // 寫入的新增筆數 (僅寫入異動資料時)
+	Updated    int64         `json:"updated" bson:"updated"`         // 寫入的更新筆數 (僅寫入異動資料時)
+	Unchanged  int64         `json:"unchanged" bson:"unchanged"`     // 未異動而略過寫入筆數
+	Skipped    int64         `json:"skipped" bson:"skipped"`         // 收到但未寫入筆數
+	Failed     int64         `json:"failed" bson:"failed"`           // 寫入失敗筆數
+	APICalls   int64         `json:"api_calls" bson:"api_calls"`     // QDM API 呼叫次數
+	Violations int           `json:"violations" bson:"violations"`   // 違反驗證規則數
+	Outcome    RunOutcome    `json:"outcome" bson:"outcome"`         // running, succeeded 或 failed
+	Error      string        `json:"error,omitempty" bson:"error"`   // 失敗原因
+	Warnings   []string      `json:"warnings,omitempty" bson:"warnings"`
+}
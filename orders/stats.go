@@ -0,0 +1,25 @@
+package orders
+
+import "time"
+
+// CustomerStats aggregates the stored orders of a customer.
+type CustomerStats struct {
+	CustomerID        int              `json:"customer_id" bson:"_id"`                         // 會員編號
+	OrderCount        int              `json:"order_count" bson:"order_count"`                 // 訂單數
+	FirstOrderAt      time.Time        `json:"first_order_at" bson:"first_order_at"`           // 首次購買時間
+	LastOrderAt       time.Time        `json:"last_order_at" bson:"last_order_at"`             // 最近購買時間
+	TotalAmount       float64          `json:"total_amount" bson:"total_amount"`               // 消費總金額 (不含已取消)
+	AverageOrderValue float64          `json:"average_order_value" bson:"average_order_value"` // 平均訂單金額 (不含已取消)
+	CancelledCount    int              `json:"cancelled_count" bson:"cancelled_count"`         // 已取消訂單數
+	ReturnedCount     int              `json:"returned_count" bson:"returned_count"`           // 申請退換貨訂單數
+	FavouriteProducts []ProductSummary `json:"favourite_products" bson:"favourite_products"`   // 最常購買商品 (依數量)
+	UpdatedAt         time.Time        `json:"updated_at" bson:"updated_at"`                   // 彙總時間
+}
+
+// ProductSummary is how much of a product a customer bought.
+type ProductSummary struct {
+	ProductID int    `json:"product_id" bson:"product_id"` // 商品編號
+	Name      string `json:"name" bson:"name"`             // 商品名稱
+	Quantity  int    `json:"quantity" bson:"quantity"`     // 購買數量
+	Orders    int    `json:"orders" bson:"orders"`         // 購買訂單數
+}
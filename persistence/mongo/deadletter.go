@@ -0,0 +1,94 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func (repo *orderRepository) StoreDeadLetters(ctx context.Context, letters []orders.DeadLetter) (err error) {
+	coll := repo.db.Collection("dead_letters")
+
+	ctx, span := startSpan(ctx, "mongo.StoreDeadLetters", coll.Name(), len(letters))
+	defer func() { endSpan(span, err) }()
+
+	if len(letters) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	models := make([]mongo.WriteModel, len(letters))
+	for i, l := range letters {
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: l.ID}}).
+			SetReplacement(l).
+			SetUpsert(true)
+	}
+
+	_, err = coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func (repo *orderRepository) DeadLetters(ctx context.Context, filter orders.DeadLetterFilter) (letters []orders.DeadLetter, err error) {
+	coll := repo.db.Collection("dead_letters")
+
+	ctx, span := startSpan(ctx, "mongo.DeadLetters", coll.Name(), 0)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}}).
+		SetLimit(int64(filter.Limit))
+
+	cur, err := coll.Find(ctx, deadLetterFilter(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(ctx, &letters)
+	return letters, err
+}
+
+func (repo *orderRepository) DeleteDeadLetters(ctx context.Context, filter orders.DeadLetterFilter) (n int64, err error) {
+	coll := repo.db.Collection("dead_letters")
+
+	ctx, span := startSpan(ctx, "mongo.DeleteDeadLetters", coll.Name(), len(filter.IDs))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	result, err := coll.DeleteMany(ctx, deadLetterFilter(filter))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+func deadLetterFilter(filter orders.DeadLetterFilter) bson.D {
+	f := bson.D{}
+
+	if filter.Entity != "" {
+		f = append(f, bson.E{Key: "entity", Value: filter.Entity})
+	}
+
+	if filter.RunID != "" {
+		f = append(f, bson.E{Key: "run_id", Value: filter.RunID})
+	}
+
+	if filter.IDs != nil {
+		f = append(f, bson.E{Key: "_id", Value: bson.D{{Key: "$in", Value: filter.IDs}}})
+	}
+
+	return f
+}
@@ -0,0 +1,108 @@
+package mongo
+
+import (
+	"bytes"
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// diff compares the documents with the stored ones matching the same key,
+// reporting which would be created, updated or left unchanged.
+func diff(ctx context.Context, coll *mongo.Collection, key string, ids []int, docs []bson.Raw) ([]orders.Change, error) {
+	stored, err := storedDocs(ctx, coll, key, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]orders.Change, len(docs))
+	for i, doc := range docs {
+		changes[i].ID = ids[i]
+
+		old, ok := stored[ids[i]]
+		if !ok {
+			changes[i].Type = orders.Created
+			continue
+		}
+
+		fields, err := changedFields(old, doc)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fields) == 0 {
+			changes[i].Type = orders.Unchanged
+			continue
+		}
+
+		changes[i].Type = orders.Updated
+		changes[i].Fields = fields
+	}
+
+	return changes, nil
+}
+
+// storedDocs reads the stored documents with the given IDs by ID.
+func storedDocs(ctx context.Context, coll *mongo.Collection, key string, ids []int) (map[int]bson.Raw, error) {
+	filter := bson.D{{Key: key, Value: bson.D{{Key: "$in", Value: ids}}}}
+
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	stored := make(map[int]bson.Raw, len(ids))
+	for cur.Next(ctx) {
+		id, ok := cur.Current.Lookup(key).AsInt64OK()
+		if !ok {
+			continue
+		}
+
+		// the cursor reuses the buffer of Current
+		stored[int(id)] = append(bson.Raw(nil), cur.Current...)
+	}
+
+	return stored, cur.Err()
+}
+
+// changedFields lists the top-level fields that differ between two
+// documents, ignoring the _id assigned by Mongo.
+func changedFields(old bson.Raw, new bson.Raw) ([]string, error) {
+	newElems, err := new.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	oldElems, err := old.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	for _, elem := range newElems {
+		key := elem.Key()
+		value := elem.Value()
+
+		prev := old.Lookup(key)
+		if prev.Type != value.Type || !bytes.Equal(prev.Value, value.Value) {
+			fields = append(fields, key)
+		}
+	}
+
+	for _, elem := range oldElems {
+		key := elem.Key()
+		if key == "_id" {
+			continue
+		}
+
+		if _, err := new.LookupErr(key); err != nil {
+			fields = append(fields, key)
+		}
+	}
+
+	return fields, nil
+}
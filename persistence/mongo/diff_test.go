@@ -0,0 +1,55 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestChangedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	group := orders.CustomerGroup{
+		CustomerGroupID: 1,
+		Name:            "VIP",
+		Approval:        1,
+	}
+
+	old, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "customer_group_id", Value: 1},
+		{Key: "name", Value: "VIP"},
+		{Key: "description", Value: ""},
+		{Key: "approval", Value: 0},
+		{Key: "effective_period", Value: 0},
+		{Key: "renewal_by_amount", Value: 0},
+		{Key: "renewal_by_total", Value: 0},
+		{Key: "legacy", Value: true},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	new, err := bson.Marshal(group)
+	if !assert.NoError(err) {
+		return
+	}
+
+	fields, err := changedFields(old, new)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]string{"approval", "legacy"}, fields)
+
+	fields, err = changedFields(new, new)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Empty(fields)
+}
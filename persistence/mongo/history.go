@@ -0,0 +1,162 @@
+package mongo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// recordHistory appends a version to order_history for every order of the
+// batch that is new or differs from its stored document, before the documents
+// are replaced. A version recorded by a sync whose documents were then not
+// written matches the latest version and is not recorded again.
+func (repo *orderRepository) recordHistory(ctx context.Context, batch []orders.Order, docs []bson.Raw, stored map[int]bson.Raw) (err error) {
+	coll := repo.db.Collection("order_history")
+
+	ctx, span := startSpan(ctx, "mongo.RecordHistory", coll.Name(), len(batch))
+	defer func() { endSpan(span, err) }()
+
+	ids := make([]int, len(batch))
+	for i, o := range batch {
+		ids[i] = o.OrderID
+	}
+
+	latest, err := latestVersions(ctx, coll, ids)
+	if err != nil {
+		return err
+	}
+
+	vs, err := versions(batch, docs, stored, latest, time.Now())
+	if err != nil || len(vs) == 0 {
+		return err
+	}
+
+	start := time.Now()
+	_, err = coll.InsertMany(ctx, vs)
+	observeWrite(coll.Name(), len(vs), start, err)
+	return err
+}
+
+// latestVersion is the latest recorded version of an order.
+type latestVersion struct {
+	Version int
+	Hash    string
+}
+
+// latestVersions returns the latest recorded version of each order.
+func latestVersions(ctx context.Context, coll *mongo.Collection, ids []int) (map[int]latestVersion, error) {
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "order_id", Value: bson.D{{Key: "$in", Value: ids}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "version", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$order_id"},
+			{Key: "version", Value: bson.D{{Key: "$last", Value: "$version"}}},
+			{Key: "hash", Value: bson.D{{Key: "$last", Value: "$hash"}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	latest := make(map[int]latestVersion, len(ids))
+	for cur.Next(ctx) {
+		var v struct {
+			OrderID int    `bson:"_id"`
+			Version int    `bson:"version"`
+			Hash    string `bson:"hash"`
+		}
+
+		if err := cur.Decode(&v); err != nil {
+			return nil, err
+		}
+
+		latest[v.OrderID] = latestVersion{v.Version, v.Hash}
+	}
+
+	return latest, cur.Err()
+}
+
+// versions builds the history entries of the orders that are new or differ
+// from their stored documents, numbered after their latest versions, leaving
+// out those already recorded as the latest version. docs are the documents of
+// the orders as stored.
+func versions(batch []orders.Order, docs []bson.Raw, stored map[int]bson.Raw, latest map[int]latestVersion, now time.Time) ([]any, error) {
+	var vs []any
+	for i, o := range batch {
+		raw := docs[i]
+
+		var changes []orders.FieldChange
+		if old, ok := stored[o.OrderID]; ok {
+			fields, err := changedFields(old, raw)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(fields) == 0 {
+				continue
+			}
+
+			for _, field := range fields {
+				changes = append(changes, orders.FieldChange{
+					Field: field,
+					Old:   old.Lookup(field),
+					New:   raw.Lookup(field),
+				})
+			}
+		}
+
+		sum := sha256.Sum256(raw)
+		hash := hex.EncodeToString(sum[:])
+
+		last := latest[o.OrderID]
+		if last.Hash == hash {
+			continue
+		}
+
+		last.Version++
+		last.Hash = hash
+		latest[o.OrderID] = last
+
+		vs = append(vs, orders.OrderVersion{
+			OrderID:      o.OrderID,
+			Version:      last.Version,
+			RecordedAt:   now,
+			DateModified: o.DateModified,
+			Hash:         hash,
+			Changes:      changes,
+			Snapshot:     raw,
+		})
+	}
+
+	return vs, nil
+}
+
+func (repo *orderRepository) OrderHistory(ctx context.Context, id int) (history []orders.OrderVersion, err error) {
+	coll := repo.db.Collection("order_history")
+
+	ctx, span := startSpan(ctx, "mongo.OrderHistory", coll.Name(), 0)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: 1}})
+
+	cur, err := coll.Find(ctx, bson.D{{Key: "order_id", Value: id}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(ctx, &history)
+	return history, err
+}
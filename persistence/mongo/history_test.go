@@ -0,0 +1,89 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	modified := orders.QDMTime(time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local))
+
+	unchanged := orders.Order{OrderID: 1, OrderStatus: 1}
+	changed := orders.Order{OrderID: 2, OrderStatus: 3, DateModified: modified}
+	created := orders.Order{OrderID: 3, OrderStatus: 1}
+
+	stored := make(map[int]bson.Raw)
+	for _, o := range []orders.Order{unchanged, {OrderID: 2, OrderStatus: 1}} {
+		raw, err := bson.Marshal(o)
+		if !assert.NoError(err) {
+			return
+		}
+
+		stored[o.OrderID] = raw
+	}
+
+	batch := []orders.Order{unchanged, changed, created}
+
+	docs := make([]bson.Raw, len(batch))
+	for i, o := range batch {
+		raw, err := bson.Marshal(o)
+		if !assert.NoError(err) {
+			return
+		}
+
+		docs[i] = raw
+	}
+
+	latest := map[int]latestVersion{1: {Version: 1}, 2: {Version: 4}}
+
+	vs, err := versions(batch, docs, stored, latest, time.Now())
+	if !assert.NoError(err) || !assert.Len(vs, 2) {
+		return
+	}
+
+	// round trip through BSON like a stored version
+	raw, err := bson.Marshal(vs[0])
+	if !assert.NoError(err) {
+		return
+	}
+
+	var v orders.OrderVersion
+	if !assert.NoError(bson.Unmarshal(raw, &v)) {
+		return
+	}
+
+	assert.Equal(2, v.OrderID)
+	assert.Equal(5, v.Version)
+	assert.Len(v.Hash, 64)
+	assert.True(time.Time(modified).Equal(time.Time(v.DateModified)))
+	assert.Equal(int32(3), v.Snapshot.Lookup("order_status").Int32())
+
+	fields := make(map[string]orders.FieldChange)
+	for _, c := range v.Changes {
+		fields[c.Field] = c
+	}
+
+	if assert.Contains(fields, "order_status") {
+		assert.Equal(int32(1), fields["order_status"].Old.Int32())
+		assert.Equal(int32(3), fields["order_status"].New.Int32())
+	}
+	assert.Contains(fields, "date_modified")
+
+	first := vs[1].(orders.OrderVersion)
+	assert.Equal(1, first.Version)
+	assert.Empty(first.Changes)
+
+	// the versions were recorded but the documents not written, the next sync
+	// does not record them again
+	vs, err = versions(batch, docs, stored, latest, time.Now())
+	if assert.NoError(err) {
+		assert.Empty(vs)
+	}
+}
@@ -0,0 +1,248 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+// keys are the fields records are upserted and compared by, one document per
+// key.
+var keys = map[string]string{
+	"orders":          "order_id",
+	"customers":       "customer_id",
+	"customer_groups": "customer_group_id",
+}
+
+// KeyMigration reports the migration of the key of a collection to a unique
+// index.
+type KeyMigration struct {
+	Collection string // 集合
+	Key        string // 鍵
+	Index      string // 鍵索引: 已唯一為 unique，否則為要做的 create 或 replace
+	Records    int64  // 存有多份文件的紀錄數
+	Duplicates int64  // 多餘的文件數 (每筆紀錄保留最後修改的一份)
+	Removed    int64  // 已刪除的多餘文件數
+	Migrated   bool   // 是否已建立唯一索引
+}
+
+// checkKeyIndex makes sure records are upserted into a collection holding
+// one document per key.
+//
+// The unique index is only created in an empty collection. Collections filled
+// by versions inserting every sync may hold several documents of a record and
+// are left to Migrate, which removes documents.
+func checkKeyIndex(ctx context.Context, coll *mongo.Collection, key string) error {
+	spec, err := keyIndex(ctx, coll, key)
+	if err != nil {
+		return err
+	}
+
+	if isUnique(spec) {
+		return nil
+	}
+
+	if spec == nil {
+		n, err := coll.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			_, err := coll.Indexes().CreateOne(ctx, uniqueKey(key))
+			return err
+		}
+	}
+
+	return fmt.Errorf("%s: %s is not a unique index, the collection needs to be migrated (qdm-sync migrate)", coll.Name(), key)
+}
+
+// Migrate creates the unique index of the key of every collection, replacing
+// the index that is not unique.
+//
+// Collections filled before records were upserted may hold several documents
+// of a record, inserted by every sync of it. They are only removed with
+// dedupe, keeping the latest modified document of every record; otherwise
+// those collections are left as they are. A dry run reports the duplicates
+// and the indexes without changing anything.
+func Migrate(ctx context.Context, cfg sync.Persistence, dedupe bool, dryRun bool) ([]KeyMigration, error) {
+	client, err := connect(ctx, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(context.Background())
+
+	// removing the duplicates of a large collection may take a while
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
+	defer cancel()
+
+	db := client.Database(cfg.Database)
+
+	var report []KeyMigration
+	for _, name := range []string{"orders", "customers", "customer_groups"} {
+		m, err := migrateKey(ctx, db.Collection(name), keys[name], dedupe, dryRun)
+		report = append(report, m)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return report, nil
+}
+
+func migrateKey(ctx context.Context, coll *mongo.Collection, key string, dedupe bool, dryRun bool) (KeyMigration, error) {
+	m := KeyMigration{
+		Collection: coll.Name(),
+		Key:        key,
+	}
+
+	spec, err := keyIndex(ctx, coll, key)
+	if err != nil {
+		return m, err
+	}
+
+	switch {
+	case isUnique(spec):
+		m.Index = "unique"
+		return m, nil
+
+	case spec == nil:
+		m.Index = "create"
+
+	default:
+		m.Index = "replace"
+	}
+
+	m.Records, m.Duplicates, err = duplicates(ctx, coll, key, nil)
+	if err != nil {
+		return m, err
+	}
+
+	if dryRun || (m.Duplicates > 0 && !dedupe) {
+		return m, nil
+	}
+
+	if m.Duplicates > 0 {
+		_, _, err = duplicates(ctx, coll, key, func(stale []any) error {
+			result, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": stale}})
+			if err != nil {
+				return err
+			}
+
+			m.Removed += result.DeletedCount
+			return nil
+		})
+		if err != nil {
+			return m, err
+		}
+	}
+
+	if spec != nil {
+		if _, err := coll.Indexes().DropOne(ctx, spec.Name); err != nil {
+			return m, err
+		}
+	}
+
+	if _, err := coll.Indexes().CreateOne(ctx, uniqueKey(key)); err != nil {
+		return m, err
+	}
+
+	m.Migrated = true
+	return m, nil
+}
+
+func uniqueKey(key string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: key, Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+}
+
+// keyIndex is the index of the key alone, nil when there is none.
+func keyIndex(ctx context.Context, coll *mongo.Collection, key string) (*mongo.IndexSpecification, error) {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return findKeyIndex(specs, key), nil
+}
+
+func findKeyIndex(specs []*mongo.IndexSpecification, key string) *mongo.IndexSpecification {
+	for _, spec := range specs {
+		elems, err := spec.KeysDocument.Elements()
+		if err != nil || len(elems) != 1 {
+			continue
+		}
+
+		if elems[0].Key() == key {
+			return spec
+		}
+	}
+
+	return nil
+}
+
+func isUnique(spec *mongo.IndexSpecification) bool {
+	return spec != nil && spec.Unique != nil && *spec.Unique
+}
+
+// duplicates counts the records held by several documents and the documents
+// other than the latest modified one, passing the IDs of those documents to
+// stale when it is given.
+func duplicates(ctx context.Context, coll *mongo.Collection, key string, stale func([]any) error) (records int64, docs int64, err error) {
+	cur, err := coll.Aggregate(ctx, duplicatesPipeline(key), options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var dup struct {
+			Stale []any `bson:"stale"`
+		}
+
+		if err := cur.Decode(&dup); err != nil {
+			return records, docs, err
+		}
+
+		records++
+		docs += int64(len(dup.Stale))
+
+		if stale != nil {
+			if err := stale(dup.Stale); err != nil {
+				return records, docs, err
+			}
+		}
+	}
+
+	return records, docs, cur.Err()
+}
+
+// duplicatesPipeline lists the keys held by several documents, with the IDs
+// of the documents other than the latest modified one.
+func duplicatesPipeline(key string) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{
+			{Key: key, Value: 1},
+			{Key: "date_modified", Value: -1},
+			{Key: "_id", Value: -1},
+		}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$" + key},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{
+			{Key: "ids.1", Value: bson.D{{Key: "$exists", Value: true}}},
+		}}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "stale", Value: bson.D{{Key: "$slice", Value: bson.A{"$ids", 1, bson.D{{Key: "$size", Value: "$ids"}}}}}},
+		}}},
+	}
+}
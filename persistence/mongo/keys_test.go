@@ -0,0 +1,56 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDuplicatesPipeline(t *testing.T) {
+	assert := assert.New(t)
+
+	pipeline := duplicatesPipeline("order_id")
+	if !assert.Len(pipeline, 4) {
+		return
+	}
+
+	// the latest modified document comes first and is kept
+	assert.Equal(bson.D{
+		{Key: "order_id", Value: 1},
+		{Key: "date_modified", Value: -1},
+		{Key: "_id", Value: -1},
+	}, pipeline[0].Map()["$sort"])
+
+	group := pipeline[1].Map()["$group"].(bson.D).Map()
+	assert.Equal("$order_id", group["_id"])
+}
+
+func TestFindKeyIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	unique := true
+	specs := []*mongo.IndexSpecification{
+		{Name: "_id_", KeysDocument: keysDocument(bson.D{{Key: "_id", Value: 1}})},
+		{Name: "order_id_1_version_1", KeysDocument: keysDocument(bson.D{{Key: "order_id", Value: 1}, {Key: "version", Value: 1}})},
+		{Name: "order_id_1", KeysDocument: keysDocument(bson.D{{Key: "order_id", Value: 1}})},
+	}
+
+	spec := findKeyIndex(specs, "order_id")
+	if assert.NotNil(spec) {
+		assert.Equal("order_id_1", spec.Name)
+	}
+	assert.False(isUnique(spec))
+
+	specs[2].Unique = &unique
+	assert.True(isUnique(findKeyIndex(specs, "order_id")))
+
+	assert.Nil(findKeyIndex(specs, "customer_id"))
+	assert.False(isUnique(nil))
+}
+
+func keysDocument(keys bson.D) bson.Raw {
+	raw, _ := bson.Marshal(keys)
+	return raw
+}
@@ -0,0 +1,179 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"os"
+	stdsync "sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// Lock upserts the lock document only when it is missing, expired or already
+// owned; a held lock makes the upsert collide with the existing _id.
+func (repo *orderRepository) Lock(ctx context.Context, name string, owner string, ttl time.Duration, force bool) (l orders.Lease, err error) {
+	coll := repo.db.Collection("locks")
+
+	ctx, span := startSpan(ctx, "mongo.Lock", coll.Name(), 1)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	host, _ := os.Hostname()
+
+	// the holder may release the lock between the collision and the lookup
+	for range 2 {
+		now := time.Now()
+
+		filter := bson.D{{Key: "_id", Value: name}}
+		if !force {
+			filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: "expires_at", Value: bson.D{{Key: "$lte", Value: now}}}},
+				bson.D{{Key: "owner", Value: owner}},
+			}})
+		}
+
+		update := bson.D{{Key: "$set", Value: orders.Lock{
+			Name:       name,
+			Owner:      owner,
+			Host:       host,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(ttl),
+		}}}
+
+		_, err = coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil {
+			return repo.lease(coll, name, owner, ttl), nil
+		}
+
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		var held orders.Lock
+		err = coll.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&held)
+		if err == nil {
+			return nil, &orders.LockHeld{Lock: held}
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("lock contended: " + name)
+}
+
+func (repo *orderRepository) lease(coll *mongo.Collection, name string, owner string, ttl time.Duration) *lease {
+	ctx, cancel := context.WithCancel(repo.ctx)
+
+	l := &lease{
+		coll:    coll,
+		name:    name,
+		owner:   owner,
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+		lost:    make(chan struct{}),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+
+	go l.heartbeat(ctx)
+
+	return l
+}
+
+type lease struct {
+	coll    *mongo.Collection
+	name    string
+	owner   string
+	ttl     time.Duration
+	expires time.Time
+	lost    chan struct{}
+	done    chan struct{}
+	cancel  context.CancelFunc
+	once    stdsync.Once
+}
+
+// heartbeat renews the lease three times per ttl, so that a renewal can fail
+// twice before the lease expires.
+func (l *lease) heartbeat(ctx context.Context) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			renewed, err := l.renew(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+
+			lost := !renewed
+			if err != nil {
+				// a failed renewal is retried until the lease expires
+				lost = time.Now().After(l.expires)
+			}
+
+			if lost {
+				close(l.lost)
+				return
+			}
+		}
+	}
+}
+
+func (l *lease) renew(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.ttl/3)
+	defer cancel()
+
+	expires := time.Now().Add(l.ttl)
+
+	result, err := l.coll.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: l.name}, {Key: "owner", Value: l.owner}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "expires_at", Value: expires}}}},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if result.MatchedCount == 0 {
+		return false, nil
+	}
+
+	l.expires = expires
+	return true, nil
+}
+
+func (l *lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release stops the heartbeat and removes the lock, unless another owner has
+// taken it over meanwhile.
+func (l *lease) Release(ctx context.Context) (err error) {
+	l.once.Do(func() {
+		l.cancel()
+		<-l.done
+
+		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+
+		_, err = l.coll.DeleteOne(ctx,
+			bson.D{{Key: "_id", Value: l.name}, {Key: "owner", Value: l.owner}},
+		)
+	})
+
+	return err
+}
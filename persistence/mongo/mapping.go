@@ -0,0 +1,226 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+
+	"github.com/mirror520/qdm-sync/orders"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+// protected fields are relied on by the repository to match, count and
+// delete documents, to record the history of orders and to aggregate the
+// customer stats, so mappings cannot touch them.
+var protected = []string{
+	"_id", "order_id", "customer_id", "customer_group_id", "date_added", "deleted_at",
+	"date_modified", "total", "order_status", "order_items", "return_request",
+}
+
+var mappable = []string{"orders", "customers", "customer_groups"}
+
+type mapping struct {
+	op      string // rename, drop, set or derive
+	field   string
+	to      string
+	value   any
+	program *vm.Program
+}
+
+// compileMappings checks the configured mappings and compiles their
+// expressions, keyed by collection.
+func compileMappings(cfg map[string][]sync.Mapping) (map[string][]mapping, error) {
+	compiled := make(map[string][]mapping, len(cfg))
+	for coll, ms := range cfg {
+		if !slices.Contains(mappable, coll) {
+			return nil, errors.New("mappings: unknown collection " + coll)
+		}
+
+		for i, m := range ms {
+			c, err := compileMapping(m)
+			if err != nil {
+				return nil, fmt.Errorf("mappings.%s[%d]: %w", coll, i, err)
+			}
+
+			compiled[coll] = append(compiled[coll], c)
+		}
+	}
+
+	return compiled, nil
+}
+
+func compileMapping(m sync.Mapping) (mapping, error) {
+	var c mapping
+
+	n := 0
+	for op, field := range map[string]string{
+		"rename": m.Rename,
+		"drop":   m.Drop,
+		"set":    m.Set,
+		"derive": m.Derive,
+	} {
+		if field != "" {
+			c.op = op
+			c.field = field
+			n++
+		}
+	}
+
+	if n != 1 {
+		return c, errors.New("exactly one of rename, drop, set or derive required")
+	}
+
+	targets := []string{c.field}
+
+	switch c.op {
+	case "rename":
+		if m.To == "" {
+			return c, errors.New("rename requires to")
+		}
+
+		c.to = m.To
+		targets = append(targets, m.To)
+
+	case "set":
+		c.value = m.Value
+
+	case "derive":
+		if m.Expr == "" {
+			return c, errors.New("derive requires expr")
+		}
+
+		program, err := expr.Compile(m.Expr, expr.AllowUndefinedVariables())
+		if err != nil {
+			return c, err
+		}
+
+		c.program = program
+	}
+
+	for _, field := range targets {
+		if slices.Contains(protected, field) {
+			return c, errors.New("field cannot be mapped: " + field)
+		}
+	}
+
+	return c, nil
+}
+
+// apply runs the mappings over the top-level fields of a document in order,
+// so a derived expression sees the fields mapped before it.
+func apply(doc bson.D, mappings []mapping) (bson.D, error) {
+	for _, m := range mappings {
+		i := slices.IndexFunc(doc, func(e bson.E) bool { return e.Key == m.field })
+
+		switch m.op {
+		case "rename":
+			if i >= 0 {
+				doc[i].Key = m.to
+			}
+
+		case "drop":
+			if i >= 0 {
+				doc = slices.Delete(doc, i, i+1)
+			}
+
+		case "set":
+			doc = set(doc, i, m.field, m.value)
+
+		case "derive":
+			env := make(map[string]any, len(doc))
+			for _, e := range doc {
+				env[e.Key] = e.Value
+			}
+
+			value, err := expr.Run(m.program, env)
+			if err != nil {
+				return nil, fmt.Errorf("derive %s: %w", m.field, err)
+			}
+
+			doc = set(doc, i, m.field, value)
+		}
+	}
+
+	return doc, nil
+}
+
+func set(doc bson.D, i int, field string, value any) bson.D {
+	if i >= 0 {
+		doc[i].Value = value
+		return doc
+	}
+
+	return append(doc, bson.E{Key: field, Value: value})
+}
+
+// documents marshals the records of a collection and applies its mappings.
+func (repo *orderRepository) documents(coll string, records []any) ([]bson.Raw, error) {
+	mappings := repo.mappings[coll]
+
+	docs := make([]bson.Raw, len(records))
+	for i, record := range records {
+		raw, err := bson.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", orders.ErrRejected, err)
+		}
+
+		if len(mappings) > 0 {
+			var doc bson.D
+			if err := bson.Unmarshal(raw, &doc); err != nil {
+				return nil, err
+			}
+
+			doc, err = apply(doc, mappings)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", orders.ErrRejected, err)
+			}
+
+			raw, err = bson.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		docs[i] = raw
+	}
+
+	return docs, nil
+}
+
+// mapped attaches the documents of the records to their changes when the
+// collection has mappings, so that the records are published as they are
+// stored.
+func (repo *orderRepository) mapped(coll string, changes []orders.Change, docs []bson.Raw) ([]orders.Change, error) {
+	if len(repo.mappings[coll]) == 0 {
+		return changes, nil
+	}
+
+	for i, doc := range docs {
+		if changes[i].Type == orders.Unchanged {
+			continue
+		}
+
+		dec, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(doc))
+		if err != nil {
+			return nil, err
+		}
+
+		// nested documents as maps, which encode to JSON objects
+		dec.DefaultDocumentM()
+
+		var m bson.M
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+
+		changes[i].Document = m
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,119 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/mirror520/qdm-sync/orders"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+func TestMappings(t *testing.T) {
+	assert := assert.New(t)
+
+	mappings, err := compileMappings(map[string][]sync.Mapping{
+		"orders": {
+			{Rename: "bb_id", To: "buy_button_id"},
+			{Drop: "customer_user_agent"},
+			{Set: "source", Value: "qdm"},
+			{Derive: "net_total", Expr: "total - 60"},
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	repo := &orderRepository{mappings: mappings}
+
+	docs, err := repo.documents("orders", []any{
+		orders.Order{OrderID: 1, BuyButtonID: "bb", Total: 560, CustomerUserAgent: "Mozilla/5.0"},
+	})
+	if !assert.NoError(err) || !assert.Len(docs, 1) {
+		return
+	}
+
+	var doc bson.M
+	if !assert.NoError(bson.Unmarshal(docs[0], &doc)) {
+		return
+	}
+
+	assert.Equal("bb", doc["buy_button_id"])
+	assert.NotContains(doc, "bb_id")
+	assert.NotContains(doc, "customer_user_agent")
+	assert.Equal("qdm", doc["source"])
+	assert.Equal(500.0, doc["net_total"])
+	assert.EqualValues(1, doc["order_id"])
+
+	// collections without mappings are stored as is
+	docs, err = repo.documents("customers", []any{orders.Customer{CustomerID: 1}})
+	if assert.NoError(err) {
+		assert.Equal(bson.TypeString, docs[0].Lookup("email").Type)
+	}
+}
+
+func TestMappingsWithInvalidConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, cfg := range map[string]map[string][]sync.Mapping{
+		"unknown collection": {"products": {{Drop: "name"}}},
+		"no operation":       {"orders": {{To: "x"}}},
+		"two operations":     {"orders": {{Drop: "a", Set: "b"}}},
+		"rename without to":  {"orders": {{Rename: "bb_id"}}},
+		"protected field":    {"orders": {{Drop: "order_id"}}},
+		"rename to key":      {"orders": {{Rename: "bb_id", To: "date_added"}}},
+		"aggregated field":   {"orders": {{Drop: "order_items"}}},
+		"history field":      {"orders": {{Derive: "date_modified", Expr: "date_added"}}},
+		"invalid expression": {"orders": {{Derive: "x", Expr: "total -"}}},
+	} {
+		_, err := compileMappings(cfg)
+		assert.Error(err, name)
+	}
+}
+
+func TestMapped(t *testing.T) {
+	assert := assert.New(t)
+
+	mappings, err := compileMappings(map[string][]sync.Mapping{
+		"orders": {{Drop: "customer_user_agent"}},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	repo := &orderRepository{mappings: mappings}
+
+	records := []any{
+		orders.Order{OrderID: 1, CustomerUserAgent: "Mozilla/5.0"},
+		orders.Order{OrderID: 2},
+	}
+
+	docs, err := repo.documents("orders", records)
+	if !assert.NoError(err) {
+		return
+	}
+
+	changes, err := repo.mapped("orders", []orders.Change{
+		{Type: orders.Created, ID: 1},
+		{Type: orders.Unchanged, ID: 2},
+	}, docs)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// published as stored, without the dropped field
+	doc, ok := changes[0].Document.(bson.M)
+	if assert.True(ok) {
+		assert.NotContains(doc, "customer_user_agent")
+		assert.EqualValues(1, doc["order_id"])
+	}
+	assert.Nil(changes[1].Document)
+
+	// collections without mappings publish the records
+	changes, err = repo.mapped("customers", []orders.Change{{Type: orders.Created, ID: 1}}, docs[:1])
+	if assert.NoError(err) {
+		assert.Nil(changes[0].Document)
+	}
+}
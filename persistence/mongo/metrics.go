@@ -0,0 +1,44 @@
+package mongo
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	writesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "mongo",
+		Name:      "writes_total",
+		Help:      "Total number of write operations by collection and status.",
+	}, []string{"collection", "status"})
+
+	documentsWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "mongo",
+		Name:      "documents_written_total",
+		Help:      "Total number of documents written by collection.",
+	}, []string{"collection"})
+
+	writeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "mongo",
+		Name:      "write_duration_seconds",
+		Help:      "Latency of write operations by collection.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"collection"})
+)
+
+func observeWrite(collection string, n int, start time.Time, err error) {
+	writeDuration.WithLabelValues(collection).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		writesTotal.WithLabelValues(collection, "error").Inc()
+		return
+	}
+
+	writesTotal.WithLabelValues(collection, "ok").Inc()
+	documentsWritten.WithLabelValues(collection).Add(float64(n))
+}
@@ -2,8 +2,11 @@ package mongo
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
@@ -19,12 +22,19 @@ type OrderRepository interface {
 }
 
 type orderRepository struct {
-	db     *mongo.Database
-	ctx    context.Context
-	cancel context.CancelFunc
+	db       *mongo.Database
+	history  bool
+	mappings map[string][]mapping
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
 func NewOrderRepository(cfg sync.Persistence) (orders.Repository, error) {
+	mappings, err := compileMappings(cfg.Mappings)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	repo := &orderRepository{
 		ctx:    ctx,
@@ -34,15 +44,11 @@ func NewOrderRepository(cfg sync.Persistence) (orders.Repository, error) {
 	ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.Address))
+	client, err := connect(ctx, cfg.Address)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := client.Ping(ctx, readpref.Primary()); err != nil {
-		return nil, err
-	}
-
 	db := client.Database(cfg.Database)
 	if err := db.CreateCollection(ctx, "orders"); err != nil {
 		cmdErr, ok := err.(mongo.CommandError)
@@ -51,53 +57,409 @@ func NewOrderRepository(cfg sync.Persistence) (orders.Repository, error) {
 		}
 	}
 
+	for coll, key := range keys {
+		if err := checkKeyIndex(ctx, db.Collection(coll), key); err != nil {
+			client.Disconnect(context.Background())
+			return nil, err
+		}
+	}
+
+	// the customer stats aggregate the orders by customer
+	_, err = db.Collection("orders").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "customer_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// expired leases are collected by MongoDB, they no longer hold the lock
+	_, err = db.Collection("locks").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.History {
+		_, err := db.Collection("order_history").Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "order_id", Value: 1}, {Key: "version", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	repo.db = db
+	repo.history = cfg.History
+	repo.mappings = mappings
 
 	return repo, nil
 }
 
-func (repo *orderRepository) Store(orders []orders.Order) error {
+func connect(ctx context.Context, address string) (*mongo.Client, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(address))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (repo *orderRepository) Store(ctx context.Context, orders []orders.Order) (err error) {
 	coll := repo.db.Collection("orders")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "mongo.Store", coll.Name(), len(orders))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ids := make([]int, len(orders))
 	docs := make([]any, len(orders))
 	for i, o := range orders {
+		ids[i] = o.OrderID
 		docs[i] = o
 	}
 
-	_, err := coll.InsertMany(ctx, docs)
+	// the previous documents are needed to tell what changed
+	var stored map[int]bson.Raw
+	if repo.history {
+		stored, err = storedDocs(ctx, coll, "order_id", ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	raws, err := repo.documents(coll.Name(), docs)
+	if err != nil {
+		return err
+	}
+
+	// the versions are recorded first: when recording fails the documents are
+	// left as they were and the next sync records their changes again
+	if repo.history {
+		if err := repo.recordHistory(ctx, orders, raws, stored); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	err = upsert(ctx, coll, "order_id", ids, raws)
+	observeWrite(coll.Name(), len(docs), start, err)
 	return err
 }
 
-func (repo *orderRepository) StoreCustomers(customers []orders.Customer) error {
+func (repo *orderRepository) StoreCustomers(ctx context.Context, customers []orders.Customer) (err error) {
 	coll := repo.db.Collection("customers")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "mongo.StoreCustomers", coll.Name(), len(customers))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ids := make([]int, len(customers))
 	docs := make([]any, len(customers))
 	for i, c := range customers {
+		ids[i] = c.CustomerID
 		docs[i] = c
 	}
 
-	_, err := coll.InsertMany(ctx, docs)
+	raws, err := repo.documents(coll.Name(), docs)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = upsert(ctx, coll, "customer_id", ids, raws)
+	observeWrite(coll.Name(), len(docs), start, err)
 	return err
 }
 
-func (repo *orderRepository) StoreCustomerGroups(groups []orders.CustomerGroup) error {
+func (repo *orderRepository) StoreCustomerGroups(ctx context.Context, groups []orders.CustomerGroup) (err error) {
 	coll := repo.db.Collection("customer_groups")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "mongo.StoreCustomerGroups", coll.Name(), len(groups))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
+	ids := make([]int, len(groups))
 	docs := make([]any, len(groups))
 	for i, g := range groups {
+		ids[i] = g.CustomerGroupID
 		docs[i] = g
 	}
 
-	_, err := coll.InsertMany(ctx, docs)
+	raws, err := repo.documents(coll.Name(), docs)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = upsert(ctx, coll, "customer_group_id", ids, raws)
+	observeWrite(coll.Name(), len(docs), start, err)
+	return err
+}
+
+// upsert replaces the stored documents matching the key of each record and
+// inserts the missing ones, so syncing a window again does not duplicate it.
+func upsert(ctx context.Context, coll *mongo.Collection, key string, ids []int, docs []bson.Raw) error {
+	models := make([]mongo.WriteModel, len(docs))
+	for i, doc := range docs {
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: key, Value: ids[i]}}).
+			SetReplacement(doc).
+			SetUpsert(true)
+	}
+
+	_, err := coll.BulkWrite(ctx, models)
+	return rejected(err)
+}
+
+// rejected marks the write errors of documents the server refused, e.g. for a
+// duplicate key, as orders.ErrRejected, apart from failures of the server or
+// the connection.
+func rejected(err error) error {
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 && bwe.WriteConcernError == nil {
+		return fmt.Errorf("%w: %w", orders.ErrRejected, err)
+	}
+
+	return err
+}
+
+func (repo *orderRepository) Diff(ctx context.Context, orders []orders.Order) (changes []orders.Change, err error) {
+	coll := repo.db.Collection("orders")
+
+	ctx, span := startSpan(ctx, "mongo.Diff", coll.Name(), len(orders))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ids := make([]int, len(orders))
+	docs := make([]any, len(orders))
+	for i, o := range orders {
+		ids[i] = o.OrderID
+		docs[i] = o
+	}
+
+	raws, err := repo.documents(coll.Name(), docs)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err = diff(ctx, coll, "order_id", ids, raws)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.mapped(coll.Name(), changes, raws)
+}
+
+func (repo *orderRepository) DiffCustomers(ctx context.Context, customers []orders.Customer) (changes []orders.Change, err error) {
+	coll := repo.db.Collection("customers")
+
+	ctx, span := startSpan(ctx, "mongo.DiffCustomers", coll.Name(), len(customers))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ids := make([]int, len(customers))
+	docs := make([]any, len(customers))
+	for i, c := range customers {
+		ids[i] = c.CustomerID
+		docs[i] = c
+	}
+
+	raws, err := repo.documents(coll.Name(), docs)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err = diff(ctx, coll, "customer_id", ids, raws)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.mapped(coll.Name(), changes, raws)
+}
+
+func (repo *orderRepository) DiffCustomerGroups(ctx context.Context, groups []orders.CustomerGroup) (changes []orders.Change, err error) {
+	coll := repo.db.Collection("customer_groups")
+
+	ctx, span := startSpan(ctx, "mongo.DiffCustomerGroups", coll.Name(), len(groups))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	ids := make([]int, len(groups))
+	docs := make([]any, len(groups))
+	for i, g := range groups {
+		ids[i] = g.CustomerGroupID
+		docs[i] = g
+	}
+
+	raws, err := repo.documents(coll.Name(), docs)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err = diff(ctx, coll, "customer_group_id", ids, raws)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.mapped(coll.Name(), changes, raws)
+}
+
+func (repo *orderRepository) CountOrders(ctx context.Context, start time.Time, end time.Time) (int64, error) {
+	return repo.count(ctx, repo.db.Collection("orders"), start, end)
+}
+
+func (repo *orderRepository) CountCustomers(ctx context.Context, start time.Time, end time.Time) (int64, error) {
+	return repo.count(ctx, repo.db.Collection("customers"), start, end)
+}
+
+// count counts the documents added within [start, end], the window QDM
+// counts by.
+func (repo *orderRepository) count(ctx context.Context, coll *mongo.Collection, start time.Time, end time.Time) (n int64, err error) {
+	ctx, span := startSpan(ctx, "mongo.Count", coll.Name(), 0)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	return coll.CountDocuments(ctx, window(start, end))
+}
+
+// window filters the documents added within [start, end] that are not
+// soft-deleted.
+func window(start time.Time, end time.Time) bson.D {
+	return bson.D{
+		{Key: "date_added", Value: bson.D{
+			{Key: "$gte", Value: start},
+			{Key: "$lte", Value: end},
+		}},
+		{Key: "deleted_at", Value: bson.D{
+			{Key: "$exists", Value: false},
+		}},
+	}
+}
+
+func (repo *orderRepository) OrderIDs(ctx context.Context, start time.Time, end time.Time) ([]int, error) {
+	return repo.ids(ctx, repo.db.Collection("orders"), "order_id", start, end)
+}
+
+func (repo *orderRepository) CustomerIDs(ctx context.Context, start time.Time, end time.Time) ([]int, error) {
+	return repo.ids(ctx, repo.db.Collection("customers"), "customer_id", start, end)
+}
+
+func (repo *orderRepository) ids(ctx context.Context, coll *mongo.Collection, key string, start time.Time, end time.Time) (ids []int, err error) {
+	ctx, span := startSpan(ctx, "mongo.IDs", coll.Name(), 0)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetProjection(bson.D{
+		{Key: "_id", Value: 0},
+		{Key: key, Value: 1},
+	})
+
+	cur, err := coll.Find(ctx, window(start, end), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		id, ok := cur.Current.Lookup(key).AsInt64OK()
+		if ok {
+			ids = append(ids, int(id))
+		}
+	}
+
+	return ids, cur.Err()
+}
+
+func (repo *orderRepository) OrderCustomerIDs(ctx context.Context, ids []int) (customers []int, err error) {
+	coll := repo.db.Collection("orders")
+
+	ctx, span := startSpan(ctx, "mongo.OrderCustomerIDs", coll.Name(), len(ids))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	values, err := coll.Distinct(ctx, "customer_id", bson.D{
+		{Key: "order_id", Value: bson.D{{Key: "$in", Value: ids}}},
+		{Key: "customer_id", Value: bson.D{{Key: "$gt", Value: 0}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range values {
+		switch id := v.(type) {
+		case int32:
+			customers = append(customers, int(id))
+
+		case int64:
+			customers = append(customers, int(id))
+		}
+	}
+
+	return customers, nil
+}
+
+func (repo *orderRepository) DeleteOrders(ctx context.Context, ids []int, mode orders.DeleteMode) error {
+	return repo.delete(ctx, repo.db.Collection("orders"), "order_id", ids, mode)
+}
+
+func (repo *orderRepository) DeleteCustomers(ctx context.Context, ids []int, mode orders.DeleteMode) error {
+	return repo.delete(ctx, repo.db.Collection("customers"), "customer_id", ids, mode)
+}
+
+// delete removes the documents with the given IDs, or marks them with
+// deleted_at when soft deleting. A soft-deleted document that shows up in
+// QDM again is restored by the next upsert, which replaces it whole.
+func (repo *orderRepository) delete(ctx context.Context, coll *mongo.Collection, key string, ids []int, mode orders.DeleteMode) (err error) {
+	ctx, span := startSpan(ctx, "mongo.Delete", coll.Name(), len(ids))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	filter := bson.D{{Key: key, Value: bson.D{{Key: "$in", Value: ids}}}}
+
+	start := time.Now()
+	switch mode {
+	case orders.HardDelete:
+		_, err = coll.DeleteMany(ctx, filter)
+
+	case orders.SoftDelete:
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "deleted_at", Value: time.Now()},
+		}}}
+		_, err = coll.UpdateMany(ctx, filter, update)
+
+	default:
+		err = mode.Validate()
+	}
+
+	observeWrite(coll.Name(), len(ids), start, err)
 	return err
 }
 
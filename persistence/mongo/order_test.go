@@ -0,0 +1,27 @@
+package mongo
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	duplicate := mongo.BulkWriteException{
+		WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: 11000}}},
+	}
+	assert.ErrorIs(rejected(duplicate), orders.ErrRejected)
+
+	unacknowledged := duplicate
+	unacknowledged.WriteConcernError = &mongo.WriteConcernError{Code: 64}
+	assert.NotErrorIs(rejected(unacknowledged), orders.ErrRejected)
+
+	assert.NotErrorIs(rejected(errors.New("connection reset")), orders.ErrRejected)
+	assert.NoError(rejected(nil))
+}
@@ -0,0 +1,74 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func (repo *orderRepository) RecordRun(ctx context.Context, run orders.SyncRun) (err error) {
+	coll := repo.db.Collection("sync_runs")
+
+	ctx, span := startSpan(ctx, "mongo.RecordRun", coll.Name(), 1)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err = coll.ReplaceOne(ctx,
+		bson.D{{Key: "_id", Value: run.ID}},
+		run,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (repo *orderRepository) SyncRuns(ctx context.Context, entity string, limit int) (runs []orders.SyncRun, err error) {
+	coll := repo.db.Collection("sync_runs")
+
+	ctx, span := startSpan(ctx, "mongo.SyncRuns", coll.Name(), 0)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	filter := bson.D{}
+	if entity != "" {
+		filter = bson.D{{Key: "entity", Value: entity}}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "started_at", Value: -1}}).
+		SetLimit(int64(limit))
+
+	cur, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(ctx, &runs)
+	return runs, err
+}
+
+func (repo *orderRepository) SyncRun(ctx context.Context, id string) (run orders.SyncRun, err error) {
+	coll := repo.db.Collection("sync_runs")
+
+	ctx, span := startSpan(ctx, "mongo.SyncRun", coll.Name(), 1)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&run)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		err = orders.ErrRunNotFound
+	}
+
+	return run, err
+}
@@ -0,0 +1,183 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// favourites is the number of products kept in the favourite products.
+const favourites = 5
+
+// AggregateCustomerStats replaces the stats of the customers with two
+// aggregations of their orders merged into customer_stats: the order totals
+// first, then their favourite products. Cancelled orders are counted but left
+// out of the amounts; soft-deleted orders are left out altogether, and the
+// stats of customers left without orders are removed.
+func (repo *orderRepository) AggregateCustomerStats(ctx context.Context, ids []int) (n int64, err error) {
+	coll := repo.db.Collection("orders")
+
+	ctx, span := startSpan(ctx, "mongo.AggregateCustomerStats", "customer_stats", len(ids))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	// stored with millisecond precision, the stats not aggregated are older
+	now := time.Now().Truncate(time.Millisecond)
+
+	for _, pipeline := range []mongo.Pipeline{
+		totalsPipeline(ids, now),
+		favouritesPipeline(ids),
+	} {
+		cur, err := coll.Aggregate(ctx, pipeline)
+		if err != nil {
+			return 0, err
+		}
+
+		// $merge writes the output, the cursor is empty
+		if err := cur.Close(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	stats := repo.db.Collection("customer_stats")
+	if _, err := stats.DeleteMany(ctx, staleStats(ids, now)); err != nil {
+		return 0, err
+	}
+
+	return stats.CountDocuments(ctx, customerFilter(ids))
+}
+
+// staleStats matches the stats of the customers that were not aggregated at
+// now, as none of their orders are left.
+func staleStats(ids []int, now time.Time) bson.D {
+	return append(customerFilter(ids),
+		bson.E{Key: "updated_at", Value: bson.D{{Key: "$lt", Value: now}}},
+	)
+}
+
+func (repo *orderRepository) CustomerStats(ctx context.Context, ids []int) (stats []orders.CustomerStats, err error) {
+	coll := repo.db.Collection("customer_stats")
+
+	ctx, span := startSpan(ctx, "mongo.CustomerStats", coll.Name(), len(ids))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cur, err := coll.Find(ctx, customerFilter(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.All(ctx, &stats)
+	return stats, err
+}
+
+// customerFilter matches the stats of the customers, of all when ids is nil.
+func customerFilter(ids []int) bson.D {
+	if ids == nil {
+		return bson.D{}
+	}
+
+	return bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}
+}
+
+// customerOrders matches the orders of the customers that are not
+// soft-deleted, of all customers when ids is nil.
+func customerOrders(ids []int) bson.D {
+	customer := bson.D{{Key: "$gt", Value: 0}}
+	if ids != nil {
+		customer = bson.D{{Key: "$in", Value: ids}}
+	}
+
+	return bson.D{
+		{Key: "customer_id", Value: customer},
+		{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+}
+
+func totalsPipeline(ids []int, now time.Time) mongo.Pipeline {
+	cancelled := bson.D{{Key: "$eq", Value: bson.A{"$order_status", 4}}}
+	returned := bson.D{{Key: "$eq", Value: bson.A{"$return_request", 1}}}
+
+	cond := func(c bson.D, then any, otherwise any) bson.D {
+		return bson.D{{Key: "$cond", Value: bson.A{c, then, otherwise}}}
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: customerOrders(ids)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$customer_id"},
+			{Key: "order_count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "first_order_at", Value: bson.D{{Key: "$min", Value: "$date_added"}}},
+			{Key: "last_order_at", Value: bson.D{{Key: "$max", Value: "$date_added"}}},
+			{Key: "total_amount", Value: bson.D{{Key: "$sum", Value: cond(cancelled, 0, "$total")}}},
+			{Key: "counted", Value: bson.D{{Key: "$sum", Value: cond(cancelled, 0, 1)}}},
+			{Key: "cancelled_count", Value: bson.D{{Key: "$sum", Value: cond(cancelled, 1, 0)}}},
+			{Key: "returned_count", Value: bson.D{{Key: "$sum", Value: cond(returned, 1, 0)}}},
+		}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "average_order_value", Value: cond(
+				bson.D{{Key: "$gt", Value: bson.A{"$counted", 0}}},
+				bson.D{{Key: "$divide", Value: bson.A{"$total_amount", "$counted"}}},
+				0,
+			)},
+			{Key: "favourite_products", Value: bson.A{}},
+			{Key: "updated_at", Value: now},
+		}}},
+		{{Key: "$unset", Value: "counted"}},
+		{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "customer_stats"},
+			{Key: "on", Value: "_id"},
+			{Key: "whenMatched", Value: "replace"},
+			{Key: "whenNotMatched", Value: "insert"},
+		}}},
+	}
+}
+
+// favouritesPipeline ranks the products of the customers by the quantity
+// bought, giveaways left out.
+func favouritesPipeline(ids []int) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: customerOrders(ids)}},
+		{{Key: "$unwind", Value: "$order_items"}},
+		{{Key: "$match", Value: bson.D{{Key: "order_items.giveaway", Value: bson.D{{Key: "$ne", Value: 1}}}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "customer", Value: "$customer_id"},
+				{Key: "product", Value: "$order_items.product_id"},
+			}},
+			{Key: "name", Value: bson.D{{Key: "$last", Value: "$order_items.name"}}},
+			{Key: "quantity", Value: bson.D{{Key: "$sum", Value: "$order_items.quantity"}}},
+			{Key: "orders", Value: bson.D{{Key: "$addToSet", Value: "$order_id"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "quantity", Value: -1},
+			{Key: "_id.product", Value: 1},
+		}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$_id.customer"},
+			{Key: "favourite_products", Value: bson.D{{Key: "$push", Value: bson.D{
+				{Key: "product_id", Value: "$_id.product"},
+				{Key: "name", Value: "$name"},
+				{Key: "quantity", Value: "$quantity"},
+				{Key: "orders", Value: bson.D{{Key: "$size", Value: "$orders"}}},
+			}}}},
+		}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "favourite_products", Value: bson.D{{Key: "$slice", Value: bson.A{"$favourite_products", favourites}}}},
+		}}},
+		{{Key: "$merge", Value: bson.D{
+			{Key: "into", Value: "customer_stats"},
+			{Key: "on", Value: "_id"},
+			{Key: "whenMatched", Value: "merge"},
+			{Key: "whenNotMatched", Value: "discard"},
+		}}},
+	}
+}
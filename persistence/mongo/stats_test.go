@@ -0,0 +1,38 @@
+package mongo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCustomerOrders(t *testing.T) {
+	assert := assert.New(t)
+
+	all := customerOrders(nil)
+	assert.Equal(bson.D{{Key: "$gt", Value: 0}}, all.Map()["customer_id"])
+
+	some := customerOrders([]int{1, 2})
+	assert.Equal(bson.D{{Key: "$in", Value: []int{1, 2}}}, some.Map()["customer_id"])
+	assert.Contains(some.Map(), "deleted_at")
+
+	assert.Empty(customerFilter(nil))
+	assert.Len(customerFilter([]int{1}), 1)
+}
+
+func TestStaleStats(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+
+	stale := staleStats([]int{1, 2}, now).Map()
+	assert.Equal(bson.D{{Key: "$in", Value: []int{1, 2}}}, stale["_id"])
+	assert.Equal(bson.D{{Key: "$lt", Value: now}}, stale["updated_at"])
+
+	// of every customer
+	stale = staleStats(nil, now).Map()
+	assert.NotContains(stale, "_id")
+	assert.Contains(stale, "updated_at")
+}
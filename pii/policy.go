@@ -0,0 +1,285 @@
+// Package pii keeps the personal data of records out of storage and exports
+// by dropping, masking or hashing it field by field.
+package pii
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+type Action string
+
+const (
+	Keep Action = "keep" // 保留原值
+	Drop Action = "drop" // 清空
+	Mask Action = "mask" // 只保留頭尾字元
+	Hash Action = "hash" // 加鹽 SHA-256
+)
+
+// Hook compiles the actions of the fields of T, named by their bson paths
+// such as email or address_info.address, into a hook that applies them to a
+// record. Paths may cross nested structs and slices of structs; the fields
+// must be strings. Hashing requires a salt.
+func Hook[T any](salt string, fields map[string]Action) (func(*T) error, error) {
+	rules, err := compile[T](salt, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(record *T) error {
+		v := reflect.ValueOf(record).Elem()
+		for _, r := range rules {
+			r.apply(v, r.steps)
+		}
+
+		return nil
+	}, nil
+}
+
+// Redact compiles the actions like Hook into a function applying them to the
+// JSON of a T instead, e.g. to a payload that does not decode into T. Values
+// of the fields that are not strings are redacted as text, or dropped when
+// they are objects or arrays; payloads that are not JSON objects are dropped
+// whole.
+func Redact[T any](salt string, fields map[string]Action) (func([]byte) []byte, error) {
+	rules, err := compile[T](salt, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(payload []byte) []byte {
+		dec := json.NewDecoder(bytes.NewReader(payload))
+		dec.UseNumber()
+
+		var doc map[string]any
+		if err := dec.Decode(&doc); err != nil || doc == nil {
+			return nil
+		}
+
+		for _, r := range rules {
+			r.redact(doc, r.steps)
+		}
+
+		redacted, err := json.Marshal(doc)
+		if err != nil {
+			return nil
+		}
+
+		return redacted
+	}, nil
+}
+
+func compile[T any](salt string, fields map[string]Action) ([]rule, error) {
+	typ := reflect.TypeFor[T]()
+	if typ.Kind() != reflect.Struct {
+		return nil, errors.New("pii: struct type required")
+	}
+
+	var rules []rule
+	for path, action := range fields {
+		var fn func(string) string
+		switch action {
+		case Keep:
+			continue
+
+		case Drop:
+			fn = drop
+
+		case Mask:
+			fn = mask
+
+		case Hash:
+			if salt == "" {
+				return nil, errors.New("pii: salt required to hash " + path)
+			}
+
+			fn = hasher(salt)
+
+		default:
+			return nil, fmt.Errorf("pii: invalid action %q for %s", action, path)
+		}
+
+		steps, err := resolve(typ, path)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule{steps, fn})
+	}
+
+	return rules, nil
+}
+
+type step struct {
+	index int    // struct field index
+	name  string // json name of the field
+	slice bool   // the field is a slice of structs
+}
+
+type rule struct {
+	steps []step
+	fn    func(string) string
+}
+
+func (r rule) apply(v reflect.Value, steps []step) {
+	f := v.Field(steps[0].index)
+
+	if len(steps) == 1 {
+		f.SetString(r.fn(f.String()))
+		return
+	}
+
+	if !steps[0].slice {
+		r.apply(f, steps[1:])
+		return
+	}
+
+	for i := range f.Len() {
+		r.apply(f.Index(i), steps[1:])
+	}
+}
+
+func (r rule) redact(v any, steps []step) {
+	doc, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+
+	f, ok := doc[steps[0].name]
+	if !ok || f == nil {
+		return
+	}
+
+	if len(steps) > 1 {
+		if !steps[0].slice {
+			r.redact(f, steps[1:])
+			return
+		}
+
+		if elems, ok := f.([]any); ok {
+			for _, e := range elems {
+				r.redact(e, steps[1:])
+			}
+		}
+
+		return
+	}
+
+	switch value := f.(type) {
+	case string:
+		doc[steps[0].name] = r.fn(value)
+
+	case json.Number, bool:
+		doc[steps[0].name] = r.fn(fmt.Sprint(value))
+
+	default:
+		doc[steps[0].name] = nil
+	}
+}
+
+// resolve finds the fields along a bson path of typ.
+func resolve(typ reflect.Type, path string) ([]step, error) {
+	var steps []step
+
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		if typ.Kind() != reflect.Struct {
+			return nil, errors.New("pii: not a struct at " + path)
+		}
+
+		field, ok := fieldByTag(typ, name)
+		if !ok {
+			return nil, errors.New("pii: unknown field " + path)
+		}
+
+		s := step{index: field.Index[0], name: jsonName(field)}
+		typ = field.Type
+
+		if typ.Kind() == reflect.Slice && i < len(names)-1 {
+			s.slice = true
+			typ = typ.Elem()
+		}
+
+		steps = append(steps, s)
+	}
+
+	if typ.Kind() != reflect.String {
+		return nil, errors.New("pii: not a string field " + path)
+	}
+
+	return steps, nil
+}
+
+func fieldByTag(typ reflect.Type, name string) (reflect.StructField, bool) {
+	for i := range typ.NumField() {
+		f := typ.Field(i)
+
+		tag, _, _ := strings.Cut(f.Tag.Get("bson"), ",")
+		if tag == name {
+			return f, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+
+	return name
+}
+
+var hashed = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func drop(string) string {
+	return ""
+}
+
+// mask keeps the first and last characters, and the domain of an email,
+// e.g. j***n@example.com or 0********8.
+func mask(s string) string {
+	if local, domain, ok := strings.Cut(s, "@"); ok {
+		return mask(local) + "@" + domain
+	}
+
+	runes := []rune(s)
+	if len(runes) <= 2 {
+		for i := 1; i < len(runes); i++ {
+			runes[i] = '*'
+		}
+
+		return string(runes)
+	}
+
+	for i := 1; i < len(runes)-1; i++ {
+		runes[i] = '*'
+	}
+
+	return string(runes)
+}
+
+// hasher hashes normalized values, so the same email in different case or
+// padding hashes the same and stays joinable. Values already hashed are kept,
+// so a record the policy is applied to twice, as when a dead letter is
+// retried, is hashed once.
+func hasher(salt string) func(string) string {
+	return func(s string) string {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" || hashed.MatchString(s) {
+			return s
+		}
+
+		sum := sha256.Sum256([]byte(salt + s))
+		return hex.EncodeToString(sum[:])
+	}
+}
@@ -0,0 +1,142 @@
+package pii
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestHook(t *testing.T) {
+	assert := assert.New(t)
+
+	hook, err := Hook[orders.Customer]("pepper", map[string]Action{
+		"email":                   Hash,
+		"telephone":               Mask,
+		"name":                    Keep,
+		"line_user_id":            Drop,
+		"address_info.address":    Mask,
+		"reward.rows.description": Drop,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	c := orders.Customer{
+		Name:       "王小明",
+		Email:      " Ming@Example.com",
+		Telephone:  "0912345678",
+		LineUserID: "U1234",
+		AddressInfo: orders.AddressInfo{
+			Address: "中正路1號",
+		},
+		Reward: orders.Reward{
+			Rows: []orders.RewardRow{{Description: "生日禮"}, {Description: "折抵"}},
+		},
+	}
+
+	if !assert.NoError(hook(&c)) {
+		return
+	}
+
+	assert.Equal("王小明", c.Name)
+	assert.Len(c.Email, 64)
+	assert.Equal("0********8", c.Telephone)
+	assert.Empty(c.LineUserID)
+	assert.Equal("中***號", c.AddressInfo.Address)
+	assert.Empty(c.Reward.Rows[0].Description)
+	assert.Empty(c.Reward.Rows[1].Description)
+
+	// applying the policy again changes nothing
+	again := c
+	if assert.NoError(hook(&again)) {
+		assert.Equal(c.Email, again.Email)
+		assert.Equal(c.Telephone, again.Telephone)
+		assert.Equal(c.AddressInfo.Address, again.AddressInfo.Address)
+	}
+
+	// the same email hashes the same across records and entities
+	orderHook, err := Hook[orders.Order]("pepper", map[string]Action{
+		"payment_email": Hash,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	o := orders.Order{PaymentEmail: "ming@example.com"}
+	if assert.NoError(orderHook(&o)) {
+		assert.Equal(c.Email, o.PaymentEmail)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := map[string]Action{
+		"email":                   Hash,
+		"telephone":               Mask,
+		"line_user_id":            Drop,
+		"address_info.address":    Mask,
+		"reward.rows.description": Drop,
+	}
+
+	redact, err := Redact[orders.Customer]("pepper", policy)
+	if !assert.NoError(err) {
+		return
+	}
+
+	hook, err := Hook[orders.Customer]("pepper", policy)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// customer_id does not decode, the personal data is redacted anyway
+	payload := redact([]byte(`{"customer_id":"x","email":"ming@example.com","telephone":912345678,` +
+		`"line_user_id":{"id":"U1234"},"address_info":{"address":"中正路1號"},` +
+		`"reward":{"rows":[{"description":"生日禮"}]},"amount":12345678901234567890}`))
+
+	s := string(payload)
+	assert.NotContains(s, "ming@")
+	assert.NotContains(s, "912345678")
+	assert.NotContains(s, "U1234")
+	assert.NotContains(s, "中正路")
+	assert.NotContains(s, "生日禮")
+	assert.Contains(s, `"customer_id":"x"`)
+	assert.Contains(s, `"telephone":"9*******8"`)
+	assert.Contains(s, "12345678901234567890")
+
+	c := orders.Customer{Email: "ming@example.com"}
+	if assert.NoError(hook(&c)) {
+		assert.Contains(s, c.Email)
+	}
+
+	assert.Nil(redact([]byte(`{"email":"ming@exam`)))
+	assert.Nil(redact([]byte(`["ming@example.com"]`)))
+}
+
+func TestHookWithInvalidPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for name, tc := range map[string]struct {
+		salt   string
+		fields map[string]Action
+	}{
+		"unknown field":  {"pepper", map[string]Action{"emial": Hash}},
+		"not a string":   {"pepper", map[string]Action{"customer_id": Mask}},
+		"not a struct":   {"pepper", map[string]Action{"email.domain": Mask}},
+		"invalid action": {"pepper", map[string]Action{"email": "encrypt"}},
+		"no salt":        {"", map[string]Action{"email": Hash}},
+	} {
+		_, err := Hook[orders.Customer](tc.salt, tc.fields)
+		assert.Error(err, name)
+	}
+}
+
+func TestMask(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("j**n@example.com", mask("john@example.com"))
+	assert.Equal("a*", mask("ab"))
+	assert.Equal("", mask(""))
+}
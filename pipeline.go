@@ -0,0 +1,169 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/qdm"
+)
+
+type storeFunc func(ctx context.Context, items []any) error
+
+type diffFunc func(ctx context.Context, items []any) ([]orders.Change, error)
+
+// pipeline moves the items of the iterator into the repository. Pages are
+// fetched and decoded by the iterator's own goroutine, a batcher groups the
+// items into batches and several writers store them concurrently. The stages
+// are connected by bounded buffers, so a slow stage holds back the ones before
+// it instead of being polled at a fixed rate.
+//
+// report is called by the writers with the size and outcome of every batch,
+// a *deadLettered outcome telling how many of its records were set aside.
+func (svc *service) pipeline(ctx context.Context, entity string, it qdm.Iterator, store storeFunc, report func(n int, err error)) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	// unblock the batcher waiting in Fetch as soon as a writer fails
+	stop := context.AfterFunc(ctx, func() {
+		it.Close(context.Cause(ctx))
+	})
+	defer stop()
+
+	batches := make(chan []any, svc.opts.writers)
+
+	g.Go(func() error {
+		defer close(batches)
+
+		var throttle <-chan time.Time
+		if svc.opts.throttle > 0 {
+			ticker := time.NewTicker(svc.opts.throttle)
+			defer ticker.Stop()
+
+			throttle = ticker.C
+		}
+
+		for {
+			items, err := it.Fetch(svc.opts.batchSize)
+			if err != nil {
+				if errors.Is(err, qdm.EOF) {
+					return nil
+				}
+
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+
+			case batches <- items:
+			}
+
+			if throttle != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+
+				case <-throttle:
+				}
+			}
+		}
+	})
+
+	for range svc.opts.writers {
+		g.Go(func() error {
+			for batch := range batches {
+				start := time.Now()
+				err := store(ctx, batch)
+				report(len(batch), err)
+
+				// records set aside do not fail the sync
+				var dead *deadLettered
+				if errors.As(err, &dead) {
+					err = nil
+				}
+
+				observeBatch(entity, len(batch), start, err)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// diffAs adapts a typed repository diff to the items of an iterator.
+func diffAs[T any](diff func(context.Context, []T) ([]orders.Change, error)) diffFunc {
+	return func(ctx context.Context, items []any) ([]orders.Change, error) {
+		var changes []orders.Change
+		err := storeAs(func(ctx context.Context, records []T) (err error) {
+			changes, err = diff(ctx, records)
+			return err
+		})(ctx, items)
+
+		return changes, err
+	}
+}
+
+// storeAs adapts a typed repository method to the items of an iterator.
+func storeAs[T any](store func(context.Context, []T) error) storeFunc {
+	return func(ctx context.Context, items []any) error {
+		records := make([]T, len(items))
+		for i, item := range items {
+			record, ok := item.(T)
+			if !ok {
+				return errors.New("type assertion failed")
+			}
+
+			records[i] = record
+		}
+
+		return store(ctx, records)
+	}
+}
+
+// changedOnly stores only the records of a batch the diff reports as created
+// or updated, reporting how many were left out as unchanged once the others
+// are stored.
+func changedOnly(store storeFunc, diff diffFunc, counted func(created, updated, unchanged int)) storeFunc {
+	return func(ctx context.Context, items []any) error {
+		changes, err := diff(ctx, items)
+		if err != nil {
+			return err
+		}
+
+		var created, updated int
+
+		changed := make([]any, 0, len(items))
+		for i, c := range changes {
+			switch c.Type {
+			case orders.Created:
+				created++
+
+			case orders.Updated:
+				updated++
+
+			default:
+				continue
+			}
+
+			changed = append(changed, items[i])
+		}
+
+		if len(changed) > 0 {
+			if err := store(ctx, changed); err != nil {
+				return err
+			}
+		}
+
+		counted(created, updated, len(items)-len(changed))
+		return nil
+	}
+}
@@ -0,0 +1,20 @@
+package qdm
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type callsKey struct{}
+
+// CountCalls returns a context that counts into n every API request made
+// with it, including failed ones.
+func CountCalls(ctx context.Context, n *atomic.Int64) context.Context {
+	return context.WithValue(ctx, callsKey{}, n)
+}
+
+func countCall(ctx context.Context) {
+	if n, ok := ctx.Value(callsKey{}).(*atomic.Int64); ok {
+		n.Add(1)
+	}
+}
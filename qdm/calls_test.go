@@ -0,0 +1,39 @@
+package qdm
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newTestService(t, &fakeQDM{total: 650})
+
+	var calls atomic.Int64
+	ctx := CountCalls(context.Background(), &calls)
+
+	it, err := svc.FindOrders(ctx, time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	defer it.Close(nil)
+
+	for {
+		if _, err := it.Fetch(100); err != nil {
+			break
+		}
+	}
+
+	// one count and three pages of 300
+	assert.Equal(int64(4), calls.Load())
+
+	// requests made without the context are not counted
+	_, err = svc.CountOrders(context.Background(), time.Now(), time.Now())
+	assert.NoError(err)
+	assert.Equal(int64(4), calls.Load())
+}
@@ -0,0 +1,72 @@
+package qdm
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// newClient builds the HTTP client for the API according to the connection
+// settings of cfg, which must have been validated.
+func newClient(cfg Config) (*resty.Client, error) {
+	connectTimeout := cfg.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := cfg.rootCAs()
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: cfg.readTimeout(),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	if cfg.Proxy != "" {
+		proxy, err := cfg.proxyURL()
+		if err != nil {
+			return nil, err
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	client := resty.New().
+		SetTransport(transport).
+		SetBaseURL(cfg.baseURL()).
+		SetAllowGetMethodPayload(true).
+		SetHeaders(cfg.Headers)
+
+	return instrument(client), nil
+}
@@ -0,0 +1,79 @@
+package qdm
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClientWithCAFile(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/api/v1/ping", r.URL.Path)
+		assert.Equal("qdm-sync", r.Header.Get("X-Client"))
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0600); err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+
+	cfg := Config{
+		BaseURL:     srv.URL,
+		CAFile:      caFile,
+		ReadTimeout: 5 * time.Second,
+		Headers:     map[string]string{"X-Client": "qdm-sync"},
+	}
+
+	if !assert.NoError(cfg.Validate()) {
+		return
+	}
+
+	client, err := newClient(cfg)
+	if !assert.NoError(err) {
+		return
+	}
+
+	resp, err := client.R().Get("/ping")
+	if assert.NoError(err) {
+		assert.Equal(http.StatusOK, resp.StatusCode())
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := Config{
+		BaseURL:        "ecapis.qdm.cloud",
+		Proxy:          "ftp://proxy.example.com",
+		CAFile:         filepath.Join(t.TempDir(), "missing.pem"),
+		CertFile:       "client.pem",
+		ConnectTimeout: -time.Second,
+	}
+
+	err := cfg.Validate()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "proxy: unsupported scheme ftp")
+		assert.Contains(err.Error(), "caFile:")
+		assert.Contains(err.Error(), "certFile and keyFile must be set together")
+		assert.Contains(err.Error(), "connectTimeout must not be negative")
+	}
+
+	cfg = Config{
+		BaseURL: "ecapis.qdm.cloud",
+		Proxy:   "http://proxy.example.com:3128",
+	}
+
+	assert.NoError(cfg.Validate())
+	assert.Equal("https://ecapis.qdm.cloud/api/v1", cfg.baseURL())
+}
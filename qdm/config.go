@@ -1,7 +1,156 @@
 package qdm
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
 type Config struct {
-	BaseURL      string `yaml:"baseURL"`
-	ClientID     string `yaml:"clientID"`
-	ClientSecret string `yaml:"clientSecret"`
+	BaseURL          string            `yaml:"baseURL"` // host of the API, https:// is assumed without a scheme
+	ClientID         string            `yaml:"clientID"`
+	ClientSecret     Secret            `yaml:"clientSecret"`
+	ClientSecretFile string            `yaml:"clientSecretFile"` // file holding the secret, e.g. a Docker or Kubernetes secret
+	Proxy            string            `yaml:"proxy"`            // proxy URL, defaults to HTTPS_PROXY from the environment
+	CAFile           string            `yaml:"caFile"`           // PEM bundle trusted in addition to the system roots
+	CertFile         string            `yaml:"certFile"`         // PEM client certificate
+	KeyFile          string            `yaml:"keyFile"`          // PEM key of the client certificate
+	ConnectTimeout   time.Duration     `yaml:"connectTimeout"`   // dial and TLS handshake timeout (default 10s)
+	ReadTimeout      time.Duration     `yaml:"readTimeout"`      // timeout waiting for response headers, then for every read of the body (default 60s)
+	Headers          map[string]string `yaml:"headers"`          // custom headers sent with every request
+	DebugHTTP        bool              `yaml:"debugHTTP"`        // logs requests and responses with credentials and PII redacted
+}
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultReadTimeout    = 60 * time.Second
+)
+
+// Resolve fills in the credentials from the environment (QDM_CLIENT_ID,
+// QDM_CLIENT_SECRET), which take precedence over the configuration, or from
+// ClientSecretFile.
+func (cfg *Config) Resolve() error {
+	if id, ok := os.LookupEnv("QDM_CLIENT_ID"); ok {
+		cfg.ClientID = id
+	}
+
+	if secret, ok := os.LookupEnv("QDM_CLIENT_SECRET"); ok {
+		cfg.ClientSecret = Secret(secret)
+		cfg.ClientSecretFile = ""
+	}
+
+	if cfg.ClientSecretFile != "" {
+		if cfg.ClientSecret != "" {
+			return errors.New("clientSecret and clientSecretFile are mutually exclusive")
+		}
+
+		data, err := os.ReadFile(cfg.ClientSecretFile)
+		if err != nil {
+			return err
+		}
+
+		cfg.ClientSecret = Secret(strings.TrimRight(string(data), "\r\n"))
+	}
+
+	return nil
+}
+
+// Validate checks the connection settings, reporting every problem found.
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.BaseURL == "" {
+		errs = append(errs, errors.New("baseURL required"))
+	} else if _, err := url.Parse(cfg.baseURL()); err != nil {
+		errs = append(errs, fmt.Errorf("baseURL: %w", err))
+	}
+
+	if cfg.Proxy != "" {
+		if _, err := cfg.proxyURL(); err != nil {
+			errs = append(errs, fmt.Errorf("proxy: %w", err))
+		}
+	}
+
+	if cfg.CAFile != "" {
+		if _, err := cfg.rootCAs(); err != nil {
+			errs = append(errs, fmt.Errorf("caFile: %w", err))
+		}
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		errs = append(errs, errors.New("certFile and keyFile must be set together"))
+	} else if cfg.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("certFile: %w", err))
+		}
+	}
+
+	if cfg.ConnectTimeout < 0 {
+		errs = append(errs, errors.New("connectTimeout must not be negative"))
+	}
+
+	if cfg.ReadTimeout < 0 {
+		errs = append(errs, errors.New("readTimeout must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (cfg *Config) baseURL() string {
+	base := cfg.BaseURL
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+
+	return strings.TrimSuffix(base, "/") + "/api/v1"
+}
+
+func (cfg *Config) readTimeout() time.Duration {
+	if cfg.ReadTimeout == 0 {
+		return defaultReadTimeout
+	}
+
+	return cfg.ReadTimeout
+}
+
+func (cfg *Config) proxyURL() (*url.URL, error) {
+	u, err := url.Parse(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("unsupported scheme " + u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+
+	return u, nil
+}
+
+func (cfg *Config) rootCAs() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + cfg.CAFile)
+	}
+
+	return pool, nil
 }
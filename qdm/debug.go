@@ -0,0 +1,161 @@
+package qdm
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+// debugBodyLimit is the number of body bytes kept in debug logs.
+const debugBodyLimit = 2048
+
+// piiFields are JSON keys whose string values are redacted from logged bodies.
+var piiFields = []string{
+	"access_token",
+	"name", "email", "telephone", "birthday", "address",
+	"payment_name", "payment_email", "payment_telephone", "payment_account",
+	"shipping_name", "shipping_telephone", "shipping_address",
+	"return_name", "return_email", "return_telephone", "return_address", "return_return_bank",
+	"invoice_title", "invoice_address", "invoice_carrier_num",
+	"customer_ip_address", "customer_user_agent",
+	"facebook_user_id", "line_user_id",
+	"comment", "return_comment",
+}
+
+var piiPattern = regexp.MustCompile(`"(` + strings.Join(piiFields, "|") + `)"(\s*:\s*)"(?:[^"\\]|\\.)*(?:"|\\?$)`)
+
+// redactBody masks PII values in a JSON body. It works on the raw text so that
+// bodies truncated for logging are redacted as well, including a value cut
+// before its closing quote.
+func redactBody(body []byte) string {
+	return piiPattern.ReplaceAllString(string(body), `"$1"$2"`+redacted+`"`)
+}
+
+func truncate(body []byte) []byte {
+	if len(body) > debugBodyLimit {
+		return body[:debugBodyLimit]
+	}
+
+	return body
+}
+
+var sensitiveHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "token", "secret", "key"}
+
+func redactHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for k := range header {
+		v := header.Get(k)
+
+		lower := strings.ToLower(k)
+		for _, s := range sensitiveHeaders {
+			if strings.Contains(lower, s) {
+				v = redacted
+				break
+			}
+		}
+
+		headers[k] = v
+	}
+
+	return headers
+}
+
+// debugHTTP logs every request of the client with credentials and customer
+// PII redacted.
+func debugHTTP(client *resty.Client, log *zap.Logger) {
+	log = log.With(zap.String("action", "debug_http"))
+
+	client.
+		OnSuccess(func(c *resty.Client, resp *resty.Response) {
+			fields := requestFields(resp.Request)
+			fields = append(fields,
+				zap.Int("status", resp.StatusCode()),
+				zap.Duration("latency", resp.Time()),
+				zap.Any("response_headers", redactHeaders(resp.Header())),
+			)
+
+			if body := resp.Body(); len(body) > 0 {
+				fields = append(fields,
+					zap.Int("body_size", len(body)),
+					zap.String("body", redactBody(truncate(body))),
+				)
+			}
+
+			log.Debug("http response", fields...)
+		}).
+		OnError(func(req *resty.Request, err error) {
+			fields := requestFields(req)
+			fields = append(fields,
+				zap.Duration("latency", time.Since(req.Time)),
+				zap.Error(err),
+			)
+
+			log.Debug("http error", fields...)
+		})
+}
+
+func requestFields(req *resty.Request) []zap.Field {
+	fields := []zap.Field{
+		zap.String("method", req.Method),
+		zap.String("url", req.URL),
+	}
+
+	if len(req.QueryParam) > 0 {
+		fields = append(fields, zap.String("query", req.QueryParam.Encode()))
+	}
+
+	if len(req.FormData) > 0 {
+		fields = append(fields, zap.String("form", req.FormData.Encode()))
+	}
+
+	if req.RawRequest != nil {
+		fields = append(fields, zap.Any("request_headers", redactHeaders(req.RawRequest.Header)))
+	}
+
+	return fields
+}
+
+// debugBody keeps the beginning of a streamed body and logs it once the body
+// is closed, since streamed responses are not available to the client hooks.
+type debugBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	size int
+	log  *zap.Logger
+}
+
+func newDebugBody(body io.ReadCloser, log *zap.Logger, endpoint string) io.ReadCloser {
+	return &debugBody{
+		ReadCloser: body,
+		log: log.With(
+			zap.String("action", "debug_http"),
+			zap.String("endpoint", endpoint),
+		),
+	}
+}
+
+func (b *debugBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if remain := debugBodyLimit - b.buf.Len(); remain > 0 {
+		b.buf.Write(p[:min(n, remain)])
+	}
+
+	b.size += n
+	return n, err
+}
+
+func (b *debugBody) Close() error {
+	b.log.Debug("http response body",
+		zap.Int("body_read", b.size),
+		zap.String("body", redactBody(b.buf.Bytes())),
+	)
+
+	return b.ReadCloser.Close()
+}
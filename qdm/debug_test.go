@@ -0,0 +1,83 @@
+package qdm
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedactBody(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"data":{"result":[{"customer_id":1,"name":"王小明","email":"a@example.com","telephone":"0912345678",` +
+		`"address_info":{"postcode":"100","address":"中正路 1 號"},"comment":"say \"hi\"","order_id":2}]}}`
+
+	redactedBody := redactBody([]byte(body))
+
+	assert.NotContains(redactedBody, "王小明")
+	assert.NotContains(redactedBody, "a@example.com")
+	assert.NotContains(redactedBody, "0912345678")
+	assert.NotContains(redactedBody, "中正路")
+	assert.NotContains(redactedBody, "hi")
+	assert.Contains(redactedBody, `"email":"[REDACTED]"`)
+	assert.Contains(redactedBody, `"postcode":"100"`)
+	assert.Contains(redactedBody, `"order_id":2`)
+
+	// a body truncated in the middle of a value keeps the partial value out
+	truncated := redactBody([]byte(`{"name":"王小明","email":"a@exa`))
+	assert.NotContains(truncated, "王小明")
+	assert.NotContains(truncated, "a@exa")
+	assert.Contains(truncated, `"email":"[REDACTED]"`)
+
+	assert.NotContains(redactBody([]byte(`{"email":"alice@example.com"}`)[:20]), "alice")
+	assert.NotContains(redactBody([]byte(`{"comment":"say \"hi\"`)[:20]), "hi")
+}
+
+func TestDebugHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	core, logs := observer.New(zap.DebugLevel)
+
+	svc := newTestService(t, &fakeQDM{total: 10})
+	svc.cfg.DebugHTTP = true
+	svc.log = zap.New(core)
+	svc.token = "jwt-token"
+
+	debugHTTP(svc.client, svc.log)
+
+	it, err := svc.FindOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	for {
+		if _, err := it.Fetch(100); err != nil {
+			break
+		}
+	}
+
+	it.Close(nil)
+
+	entries := logs.All()
+	if !assert.Len(entries, 3) { // count, orders, orders body
+		return
+	}
+
+	assert.Equal("http response", entries[0].Message)
+	assert.Equal("http response body", entries[2].Message)
+
+	for _, entry := range entries {
+		assert.NotContains(fmt.Sprint(entry.ContextMap()), "jwt-token")
+	}
+
+	fields := entries[0].ContextMap()
+	assert.Equal("GET", fields["method"])
+	assert.Equal(int64(200), fields["status"])
+	assert.Contains(fields["form"], "created_at_min")
+	assert.Equal(redacted, fields["request_headers"].(map[string]string)["Authorization"])
+}
@@ -2,40 +2,95 @@ package qdm
 
 import (
 	"context"
-	"sync"
+	"errors"
+	"sync/atomic"
 )
 
 type Iterator interface {
 	Fetch(batch int) ([]any, error)
-	Count() int64
+	Count() int64    // total_count reported by the latest page
+	Expected() int64 // count reported before paging started
+	Fetched() int64  // items handed out so far
 	Close(err error)
 	Done() <-chan struct{}
 	Error() error
 }
 
+// producer pushes items through send until the data set is exhausted and
+// reports the total_count of every page through total. send fails with the
+// cancellation cause once the iterator is closed, which the producer must
+// return.
+type producer func(ctx context.Context, send func(item any) error, total func(n int64)) error
+
+// iterator hands out the items of a producer goroutine. The producer is the
+// only writer of ch and closes it when it returns; a terminal error cancels
+// the iterator context with the error as its cause.
 type iterator struct {
-	count     int64
-	cursor    int64
-	ch        chan any
-	errCh     <-chan error
-	ctx       context.Context
-	cancel    context.CancelCauseFunc
-	closeOnce sync.Once
+	entity   string
+	expected int64
+	count    atomic.Int64
+	cursor   atomic.Int64
+	ch       <-chan any
+	done     chan struct{} // closed once the producer has returned
+	closed   atomic.Bool
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+}
+
+func newIterator(ctx context.Context, entity string, count int64, size int, produce producer) *iterator {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	ch := make(chan any, size)
+	it := &iterator{
+		entity:   entity,
+		expected: count,
+		ch:       ch,
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	it.count.Store(count)
+
+	go func() {
+		err := produce(ctx, func(item any) error {
+			select {
+			case <-ctx.Done():
+				return context.Cause(ctx)
+
+			case ch <- item:
+				iteratorBuffered.WithLabelValues(entity).Set(float64(len(ch)))
+				return nil
+			}
+		}, it.count.Store)
+
+		if err != nil && !errors.Is(err, EOF) {
+			cancel(err)
+		}
+
+		close(ch)
+		close(it.done)
+	}()
+
+	return it
 }
 
+// Fetch returns up to batch items, blocking until they are available. It
+// relies on the producer rather than on the expected count to tell the end of
+// the data set, which may change while paging. Once everything has been
+// consumed it returns EOF, or the terminal error if the
+// producer failed.
 func (it *iterator) Fetch(batch int) ([]any, error) {
-	if it.cursor >= it.count {
-		return nil, EOF
+	if it.closed.Load() {
+		return nil, it.Error()
 	}
 
-	items := make([]any, 0)
+	items := make([]any, 0, batch)
 	for item := range it.ch {
 		items = append(items, item)
-		it.cursor++
+		it.cursor.Add(1)
 
-		if it.cursor >= it.count {
-			return items, nil
-		}
+		iteratorBuffered.WithLabelValues(it.entity).Set(float64(len(it.ch)))
 
 		if len(items) == batch {
 			return items, nil
@@ -44,6 +99,10 @@ func (it *iterator) Fetch(batch int) ([]any, error) {
 
 	// channel closed
 	if len(items) == 0 {
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+
 		return nil, EOF
 	}
 
@@ -51,38 +110,37 @@ func (it *iterator) Fetch(batch int) ([]any, error) {
 }
 
 func (it *iterator) Count() int64 {
-	return it.count
+	return it.count.Load()
+}
+
+func (it *iterator) Expected() int64 {
+	return it.expected
 }
 
+func (it *iterator) Fetched() int64 {
+	return it.cursor.Load()
+}
+
+// Close stops the producer and waits for it to return. Items still buffered
+// are discarded.
 func (it *iterator) Close(err error) {
-	it.closeOnce.Do(func() {
-		if it.cancel != nil {
-			it.cancel(err)
-		}
+	it.closed.Store(true)
+	it.cancel(err)
+	<-it.done
 
-		if it.ch != nil {
-			close(it.ch)
-		}
-	})
+	iteratorBuffered.WithLabelValues(it.entity).Set(0)
 }
 
+// Done is closed when the iterator has been closed or the producer failed.
 func (it *iterator) Done() <-chan struct{} {
 	return it.ctx.Done()
 }
 
+// Error returns the reason the iterator is done, or nil while it is running.
 func (it *iterator) Error() error {
-	return it.ctx.Err()
-}
-
-func (it *iterator) handle(ctx context.Context, errCh <-chan error) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-
-		case err := <-errCh:
-			it.Close(err)
-			return
-		}
+	if it.ctx.Err() == nil {
+		return nil
 	}
+
+	return context.Cause(it.ctx)
 }
@@ -0,0 +1,299 @@
+package qdm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeQDM serves /orders/count and /orders with total orders split into
+// pages. counted, when positive, is reported by /orders/count instead of
+// total to simulate orders changing between counting and paging. failPage,
+// when positive, answers that page with an error result. stallPage, when
+// positive, stops writing that page halfway until the request is canceled.
+type fakeQDM struct {
+	total     int
+	counted   int
+	failPage  int
+	stallPage int
+}
+
+func (f *fakeQDM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	params, _ := url.ParseQuery(string(body))
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.URL.Path {
+	case "/api/v1/orders/count":
+		count := f.total
+		if f.counted > 0 {
+			count = f.counted
+		}
+
+		fmt.Fprintf(w, `{"meta":{"error":false,"status":200},"data":{"count":%d}}`, count)
+
+	case "/api/v1/orders":
+		size, _ := strconv.Atoi(params.Get("page_size"))
+		num, _ := strconv.Atoi(params.Get("page_number"))
+
+		if num == f.failPage {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"meta":{"error":true,"status":500},"data":{"message":"internal error"}}`)
+			return
+		}
+
+		from := (num - 1) * size
+		to := min(from+size, f.total)
+		pageCount := (f.total + size - 1) / size
+
+		ids := make([]string, 0, size)
+		for id := from + 1; id <= to; id++ {
+			ids = append(ids, fmt.Sprintf(`{"order_id":%d}`, id))
+		}
+
+		page := fmt.Sprintf(
+			`{"meta":{"error":false,"status":200},"data":{"count":%d,"total_count":%d,"search_criteria":{"page_size":%d,"page_number":%d,"page_count":%d},"result":[%s]}}`,
+			len(ids), f.total, size, num, pageCount, strings.Join(ids, ","))
+
+		if num == f.stallPage {
+			fmt.Fprint(w, page[:len(page)/2])
+			w.(http.Flusher).Flush()
+
+			<-r.Context().Done()
+			return
+		}
+
+		fmt.Fprint(w, page)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestService(t *testing.T, handler http.Handler) *service {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	return &service{
+		client: instrument(resty.New().
+			SetBaseURL(srv.URL + "/api/v1").
+			SetAllowGetMethodPayload(true)),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func waitDone(t *testing.T, it Iterator) {
+	select {
+	case <-it.(*iterator).done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer did not return")
+	}
+}
+
+func TestIteratorFetchAll(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newTestService(t, &fakeQDM{total: 650})
+
+	it, err := svc.FindOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	defer it.Close(nil)
+
+	var n int
+	for {
+		items, err := it.Fetch(100)
+		if err != nil {
+			assert.ErrorIs(err, EOF)
+			break
+		}
+
+		n += len(items)
+	}
+
+	assert.Equal(650, n)
+	waitDone(t, it)
+	assert.NoError(it.Error())
+}
+
+func TestIteratorCloseEarly(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newTestService(t, &fakeQDM{total: 2000})
+
+	it, err := svc.FindOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	items, err := it.Fetch(10)
+	assert.NoError(err)
+	assert.Len(items, 10)
+
+	// the producer is blocked on a full buffer by now
+	it.Close(nil)
+	waitDone(t, it)
+
+	assert.ErrorIs(it.Error(), context.Canceled)
+
+	_, err = it.Fetch(10)
+	assert.Error(err)
+}
+
+func TestIteratorCloseWithCause(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newTestService(t, &fakeQDM{total: 2000})
+
+	it, err := svc.FindOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	cause := errors.New("consumer failed")
+	it.Close(cause)
+
+	select {
+	case <-it.Done():
+	default:
+		assert.Fail("iterator not done after close")
+	}
+
+	assert.ErrorIs(it.Error(), cause)
+}
+
+func TestIteratorParentCanceled(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newTestService(t, &fakeQDM{total: 2000})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	it, err := svc.FindOrders(ctx, time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	cancel()
+	waitDone(t, it)
+
+	assert.ErrorIs(it.Error(), context.Canceled)
+}
+
+func TestIteratorServerError(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newTestService(t, &fakeQDM{total: 650, failPage: 2})
+
+	it, err := svc.FindOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	defer it.Close(nil)
+
+	var n int
+	for {
+		items, err := it.Fetch(100)
+		if err != nil {
+			if assert.Error(err) {
+				assert.Equal("internal error", err.Error())
+			}
+			break
+		}
+
+		n += len(items)
+	}
+
+	assert.Equal(300, n)
+	assert.Equal("internal error", it.Error().Error())
+}
+
+func TestIteratorCountChanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		counted int
+		total   int
+	}{
+		{"added", 600, 650},
+		{"removed", 700, 650},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			svc := newTestService(t, &fakeQDM{total: tt.total, counted: tt.counted})
+
+			it, err := svc.FindOrders(context.Background(), time.Now(), time.Now())
+			if !assert.NoError(err) {
+				return
+			}
+			defer it.Close(nil)
+
+			var n int
+			for {
+				items, err := it.Fetch(100)
+				if err != nil {
+					assert.ErrorIs(err, EOF)
+					break
+				}
+
+				n += len(items)
+			}
+
+			assert.Equal(tt.total, n)
+			assert.Equal(int64(tt.counted), it.Expected())
+			assert.Equal(int64(tt.total), it.Count())
+			assert.Equal(int64(tt.total), it.Fetched())
+		})
+	}
+}
+
+func TestIteratorStalledPage(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := newTestService(t, &fakeQDM{total: 650, stallPage: 2})
+	svc.cfg.ReadTimeout = 100 * time.Millisecond
+
+	it, err := svc.FindOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	defer it.Close(nil)
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := it.Fetch(100); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		assert.ErrorContains(err, "read timeout")
+
+	case <-time.After(5 * time.Second):
+		assert.Fail("fetch blocked on a stalled page")
+	}
+}
@@ -0,0 +1,68 @@
+package qdm
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "qdm",
+		Name:      "requests_total",
+		Help:      "Total number of QDM API requests by endpoint and status.",
+	}, []string{"endpoint", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "qdm",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of QDM API requests by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	iteratorBuffered = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "qdm_sync",
+		Subsystem: "qdm",
+		Name:      "iterator_buffered_items",
+		Help:      "Number of items fetched from QDM and waiting in the iterator buffer.",
+	}, []string{"entity"})
+)
+
+// instrument records every request of the client. OnSuccess is used rather
+// than OnAfterResponse because the latter is skipped for streamed responses.
+func instrument(client *resty.Client) *resty.Client {
+	return client.
+		OnSuccess(func(c *resty.Client, resp *resty.Response) {
+			observeRequest(resp.Request, strconv.Itoa(resp.StatusCode()), resp.Time())
+		}).
+		OnError(func(req *resty.Request, err error) {
+			observeRequest(req, "error", time.Since(req.Time))
+		})
+}
+
+func observeRequest(req *resty.Request, status string, latency time.Duration) {
+	endpoint := endpointOf(req)
+
+	requestsTotal.WithLabelValues(endpoint, status).Inc()
+	requestDuration.WithLabelValues(endpoint).Observe(latency.Seconds())
+
+	countCall(req.Context())
+}
+
+// endpointOf returns the API path of the request without the version prefix,
+// keeping the label cardinality bounded by the number of endpoints.
+func endpointOf(req *resty.Request) string {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return "unknown"
+	}
+
+	return strings.TrimPrefix(u.Path, "/api/v1")
+}
@@ -9,7 +9,8 @@ import (
 const TIME_LAYOUT string = "2006-01-02T15:04:05"
 
 var (
-	EOF = io.EOF
+	EOF          = io.EOF
+	ErrEmptyData = errors.New("empty data")
 )
 
 type ResultPagination struct {
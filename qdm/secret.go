@@ -0,0 +1,27 @@
+package qdm
+
+// Secret holds a credential in clear text while keeping it out of logs and
+// serialized output; convert it with string(s) where the value is needed.
+type Secret string
+
+const redacted = "[REDACTED]"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s Secret) MarshalYAML() (any, error) {
+	return s.String(), nil
+}
@@ -2,25 +2,30 @@ package qdm
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/mirror520/qdm-sync/orders"
 )
 
 type Service interface {
-	Authorize(id string, secret string) (*AuthData, error)
+	Authorize(ctx context.Context, id string, secret string) (*AuthData, error)
 
-	CountOrders(start time.Time, end time.Time, opts ...OrderOption) (int64, error)
-	FindOrders(start time.Time, end time.Time, opts ...OrderOption) (Iterator, error)
+	CountOrders(ctx context.Context, start time.Time, end time.Time, opts ...OrderOption) (int64, error)
+	FindOrders(ctx context.Context, start time.Time, end time.Time, opts ...OrderOption) (Iterator, error)
 
-	CountCustomers(start time.Time, end time.Time) (int64, error)
-	FindCustomers(start time.Time, end time.Time) (Iterator, error)
-	FindCustomerGroups() ([]orders.CustomerGroup, error)
+	CountCustomers(ctx context.Context, start time.Time, end time.Time) (int64, error)
+	FindCustomers(ctx context.Context, start time.Time, end time.Time) (Iterator, error)
+	FindCustomerGroups(ctx context.Context) ([]orders.CustomerGroup, error)
 
 	Close()
 }
@@ -30,18 +35,33 @@ func NewService(cfg Config) (Service, error) {
 		zap.String("service", "qdm"),
 	)
 
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return nil, errors.New("missing client credentials")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DebugHTTP {
+		debugHTTP(client, log)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	svc := &service{
-		cfg: cfg,
-		log: log,
-		client: resty.New().
-			SetBaseURL("https://" + cfg.BaseURL + "/api/v1").
-			SetAllowGetMethodPayload(true),
+		cfg:    cfg,
+		log:    log,
+		client: client,
 		ctx:    ctx,
 		cancel: cancel,
 	}
 
-	auth, err := svc.Authorize(cfg.ClientID, cfg.ClientSecret)
+	auth, err := svc.Authorize(ctx, cfg.ClientID, string(cfg.ClientSecret))
 	if err != nil {
 		return nil, err
 	}
@@ -63,9 +83,15 @@ type service struct {
 	cancel context.CancelFunc
 }
 
-func (svc *service) Authorize(id string, secret string) (*AuthData, error) {
+func (svc *service) Authorize(ctx context.Context, id string, secret string) (*AuthData, error) {
+	ctx, span := tracer.Start(ctx, "qdm.Authorize",
+		trace.WithSpanKind(trace.SpanKindClient),
+	)
+	defer span.End()
+
 	var result Result
 	resp, err := svc.client.R().
+		SetContext(ctx).
 		SetBasicAuth(id, secret).
 		SetResult(&result).
 		SetError(&Result{}).
@@ -73,16 +99,14 @@ func (svc *service) Authorize(id string, secret string) (*AuthData, error) {
 		Post("/token/authorize")
 
 	if err != nil {
+		recordError(span, err)
 		return nil, err
 	}
 
 	if resp.StatusCode() != http.StatusOK {
-		result, ok := resp.Error().(*Result)
-		if !ok {
-			return nil, errors.New(resp.String())
-		}
-
-		return nil, result.Error()
+		err := responseError(resp)
+		recordError(span, err)
+		return nil, err
 	}
 
 	return result.AuthData()
@@ -107,7 +131,7 @@ func (svc *service) refreshToken(ctx context.Context, auth *AuthData) {
 
 		case <-time.After(renewDuration):
 			for {
-				auth, err := svc.Authorize(svc.cfg.ClientID, svc.cfg.ClientSecret)
+				auth, err := svc.Authorize(ctx, svc.cfg.ClientID, string(svc.cfg.ClientSecret))
 				if err != nil {
 					log.Error(err.Error())
 
@@ -125,37 +149,136 @@ func (svc *service) refreshToken(ctx context.Context, auth *AuthData) {
 	}
 }
 
-func (svc *service) CountOrders(start time.Time, end time.Time, opts ...OrderOption) (int64, error) {
-	params := &OrderParams{
-		CreatedAtMin: start,
-		CreatedAtMax: end,
-	}
+func (svc *service) request(ctx context.Context, params url.Values) *resty.Request {
+	req := svc.client.R().
+		SetContext(ctx).
+		SetAuthToken(svc.token)
 
-	for _, opt := range opts {
-		opt.apply(params)
+	if params != nil {
+		req.SetFormDataFromValues(params)
 	}
 
+	return req
+}
+
+func startRequest(ctx context.Context, endpoint string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "qdm.GET "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("qdm.endpoint", endpoint)),
+	)
+}
+
+// get requests the endpoint with the current access token and returns the
+// result envelope, turning non-200 responses into errors.
+func (svc *service) get(ctx context.Context, endpoint string, params url.Values) (*Result, error) {
+	ctx, span := startRequest(ctx, endpoint)
+	defer span.End()
+
 	var result Result
 
-	resp, err := svc.client.R().
-		SetAuthToken(svc.token).
-		SetFormDataFromValues(params.Values()).
+	resp, err := svc.request(ctx, params).
 		SetResult(&result).
 		SetError(&Result{}).
 		ForceContentType("application/json").
-		Get("/orders/count")
+		Get(endpoint)
 
 	if err != nil {
-		return 0, err
+		recordError(span, err)
+		return nil, err
 	}
 
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode()))
+
 	if resp.StatusCode() != http.StatusOK {
-		result, ok := resp.Error().(*Result)
-		if !ok {
-			return 0, errors.New(resp.String())
+		err := responseError(resp)
+		recordError(span, err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// stream requests the endpoint like get, but hands the undecoded response body
+// to the caller, who must close it.
+func (svc *service) stream(ctx context.Context, endpoint string, params url.Values) (io.ReadCloser, error) {
+	ctx, span := startRequest(ctx, endpoint)
+	defer span.End()
+
+	// canceled once the body stalls, see idleBody
+	ctx, cancel := context.WithCancel(ctx)
+
+	resp, err := svc.request(ctx, params).
+		SetDoNotParseResponse(true).
+		Get(endpoint)
+
+	if err != nil {
+		cancel()
+		recordError(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode()))
+
+	var body io.ReadCloser = newIdleBody(resp.RawBody(), svc.cfg.readTimeout(), cancel)
+	if resp.StatusCode() != http.StatusOK {
+		defer body.Close()
+
+		err := errors.New(resp.Status())
+
+		var result Result
+		if json.NewDecoder(body).Decode(&result) == nil && result.Meta.Error {
+			err = result.Error()
 		}
 
-		return 0, result.Error()
+		recordError(span, err)
+		return nil, err
+	}
+
+	if svc.cfg.DebugHTTP {
+		body = newDebugBody(body, svc.log, endpoint)
+	}
+
+	return body, nil
+}
+
+func responseError(resp *resty.Response) error {
+	result, ok := resp.Error().(*Result)
+	if !ok {
+		return errors.New(resp.String())
+	}
+
+	return result.Error()
+}
+
+// decode runs fn within a span so that the time spent decoding a page can be
+// told apart from the time spent waiting for it.
+func decode(ctx context.Context, entity string, fn func() error) error {
+	_, span := tracer.Start(ctx, "qdm.decode",
+		trace.WithAttributes(attribute.String("qdm.entity", entity)),
+	)
+	defer span.End()
+
+	if err := fn(); err != nil {
+		recordError(span, err)
+		return err
+	}
+
+	return nil
+}
+
+func (svc *service) CountOrders(ctx context.Context, start time.Time, end time.Time, opts ...OrderOption) (int64, error) {
+	params := &OrderParams{
+		CreatedAtMin: start,
+		CreatedAtMax: end,
+	}
+
+	for _, opt := range opts {
+		opt.apply(params)
+	}
+
+	result, err := svc.get(ctx, "/orders/count", params.Values())
+	if err != nil {
+		return 0, err
 	}
 
 	data, err := result.OrderCountData()
@@ -166,7 +289,7 @@ func (svc *service) CountOrders(start time.Time, end time.Time, opts ...OrderOpt
 	return data.Count, nil
 }
 
-func (svc *service) FindOrders(start time.Time, end time.Time, opts ...OrderOption) (Iterator, error) {
+func (svc *service) FindOrders(ctx context.Context, start time.Time, end time.Time, opts ...OrderOption) (Iterator, error) {
 	params := &OrderParams{
 		CreatedAtMin: start,
 		CreatedAtMax: end,
@@ -178,112 +301,67 @@ func (svc *service) FindOrders(start time.Time, end time.Time, opts ...OrderOpti
 		opt.apply(params)
 	}
 
-	count, err := svc.CountOrders(start, end, opts...)
+	count, err := svc.CountOrders(ctx, start, end, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	if count == 0 {
-		return nil, errors.New("empty data")
+		return nil, ErrEmptyData
 	}
 
-	ch := make(chan any, params.PageSize*2)
-	errCh := make(chan error)
-	go func(ch chan<- any, errCh chan<- error) {
+	produce := func(ctx context.Context, send func(any) error, total func(int64)) error {
 		for {
-			var result Result
-
-			resp, err := svc.client.R().
-				SetAuthToken(svc.token).
-				SetFormDataFromValues(params.Values()).
-				SetResult(&result).
-				SetError(&Result{}).
-				ForceContentType("application/json").
-				Get("/orders")
-
+			body, err := svc.stream(ctx, "/orders", params.Values())
 			if err != nil {
-				errCh <- err
-				return
+				return err
 			}
 
-			if resp.StatusCode() != http.StatusOK {
-				result, ok := resp.Error().(*Result)
-				if !ok {
-					errCh <- errors.New(resp.String())
-					return
-				}
+			var page *Page
+			err = decode(ctx, "orders", func() (err error) {
+				defer body.Close()
 
-				errCh <- result.Error()
+				page, err = decodeStream(body, func(o orders.Order) error {
+					return send(o)
+				}, func(raw json.RawMessage, err error) error {
+					return send(&Invalid{Entity: "orders", Raw: raw, Err: err})
+				})
 				return
-			}
+			})
 
-			data, err := result.OrderData()
 			if err != nil {
-				errCh <- err
-				return
+				return err
 			}
 
-			if data.Count == 0 {
-				errCh <- EOF
-				return
-			}
+			total(int64(page.TotalCount))
 
-			for _, o := range data.Result {
-				ch <- o
+			if page.Count == 0 {
+				return nil
 			}
 
-			sc := data.SearchCriteria
-			if sc.PageNumber == sc.PageCount {
-				return
+			sc := page.SearchCriteria
+			if sc.PageNumber >= sc.PageCount {
+				return nil
 			}
 
 			params.PageNumber++
 		}
-	}(ch, errCh)
-
-	ctx, cancel := context.WithCancelCause(svc.ctx)
-	it := &iterator{
-		count:  count,
-		ch:     ch,
-		errCh:  errCh,
-		ctx:    ctx,
-		cancel: cancel,
 	}
 
-	go it.handle(ctx, errCh)
-
-	return it, nil
+	return newIterator(ctx, "orders", count, params.PageSize*2, produce), nil
 }
 
-func (svc *service) CountCustomers(start time.Time, end time.Time) (int64, error) {
+func (svc *service) CountCustomers(ctx context.Context, start time.Time, end time.Time) (int64, error) {
 	params := &CustomerParams{
 		CreatedAtMin: start,
 		CreatedAtMax: end,
 	}
 
-	var result Result
-
-	resp, err := svc.client.R().
-		SetAuthToken(svc.token).
-		SetFormDataFromValues(params.Values()).
-		SetResult(&result).
-		SetError(&Result{}).
-		ForceContentType("application/json").
-		Get("/customers/count")
-
+	result, err := svc.get(ctx, "/customers/count", params.Values())
 	if err != nil {
 		return 0, err
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		result, ok := resp.Error().(*Result)
-		if !ok {
-			return 0, errors.New(resp.String())
-		}
-
-		return 0, result.Error()
-	}
-
 	data, err := result.CustomerCountData()
 	if err != nil {
 		return 0, err
@@ -292,7 +370,7 @@ func (svc *service) CountCustomers(start time.Time, end time.Time) (int64, error
 	return data.Count, nil
 }
 
-func (svc *service) FindCustomers(start time.Time, end time.Time) (Iterator, error) {
+func (svc *service) FindCustomers(ctx context.Context, start time.Time, end time.Time) (Iterator, error) {
 	params := &CustomerParams{
 		CreatedAtMin: start,
 		CreatedAtMax: end,
@@ -300,107 +378,68 @@ func (svc *service) FindCustomers(start time.Time, end time.Time) (Iterator, err
 		PageNumber:   1,
 	}
 
-	count, err := svc.CountCustomers(start, end)
+	count, err := svc.CountCustomers(ctx, start, end)
 	if err != nil {
 		return nil, err
 	}
 
 	if count == 0 {
-		return nil, errors.New("empty data")
+		return nil, ErrEmptyData
 	}
 
-	ch := make(chan any, params.PageSize*2)
-	errCh := make(chan error)
-	go func(ch chan<- any, errCh chan<- error) {
+	produce := func(ctx context.Context, send func(any) error, total func(int64)) error {
 		for {
-			var result Result
-
-			resp, err := svc.client.R().
-				SetAuthToken(svc.token).
-				SetFormDataFromValues(params.Values()).
-				SetResult(&result).
-				SetError(&Result{}).
-				ForceContentType("application/json").
-				Get("/customers")
-
+			body, err := svc.stream(ctx, "/customers", params.Values())
 			if err != nil {
-				errCh <- err
-				return
+				return err
 			}
 
-			if resp.StatusCode() != http.StatusOK {
-				result, ok := resp.Error().(*Result)
-				if !ok {
-					errCh <- errors.New(resp.String())
-					return
-				}
+			var page *Page
+			err = decode(ctx, "customers", func() (err error) {
+				defer body.Close()
 
-				errCh <- result.Error()
+				page, err = decodeStream(body, func(c orders.Customer) error {
+					return send(c)
+				}, func(raw json.RawMessage, err error) error {
+					return send(&Invalid{Entity: "customers", Raw: raw, Err: err})
+				})
 				return
-			}
+			})
 
-			data, err := result.CustomerData()
 			if err != nil {
-				errCh <- err
-				return
+				return err
 			}
 
-			if data.Count == 0 {
-				errCh <- EOF
-				return
-			}
+			total(int64(page.TotalCount))
 
-			for _, c := range data.Result {
-				ch <- c
+			if page.Count == 0 {
+				return nil
 			}
 
-			sc := data.SearchCriteria
-			if sc.PageNumber == sc.PageCount {
-				return
+			sc := page.SearchCriteria
+			if sc.PageNumber >= sc.PageCount {
+				return nil
 			}
 
 			params.PageNumber++
 		}
-	}(ch, errCh)
-
-	ctx, cancel := context.WithCancelCause(svc.ctx)
-	it := &iterator{
-		count:  count,
-		ch:     ch,
-		errCh:  errCh,
-		ctx:    ctx,
-		cancel: cancel,
 	}
 
-	go it.handle(ctx, errCh)
-
-	return it, nil
+	return newIterator(ctx, "customers", count, params.PageSize*2, produce), nil
 }
 
-func (svc *service) FindCustomerGroups() ([]orders.CustomerGroup, error) {
-	var result Result
-
-	resp, err := svc.client.R().
-		SetAuthToken(svc.token).
-		SetResult(&result).
-		SetError(&Result{}).
-		ForceContentType("application/json").
-		Get("/customers/group")
-
+func (svc *service) FindCustomerGroups(ctx context.Context) ([]orders.CustomerGroup, error) {
+	result, err := svc.get(ctx, "/customers/group", nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		result, ok := resp.Error().(*Result)
-		if !ok {
-			return nil, errors.New(resp.String())
-		}
-
-		return nil, result.Error()
-	}
+	var data *CustomerGroupData
+	err = decode(ctx, "customer_groups", func() (err error) {
+		data, err = result.CustomerGroupData()
+		return
+	})
 
-	data, err := result.CustomerGroupData()
 	if err != nil {
 		return nil, err
 	}
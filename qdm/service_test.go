@@ -1,6 +1,7 @@
 package qdm
 
 import (
+	"context"
 	"testing"
 
 	"github.com/go-resty/resty/v2"
@@ -15,8 +16,15 @@ func TestAuthorizeWithFailed(t *testing.T) {
 			SetBaseURL("https://ecapis.qdm.cloud/api/v1"),
 	}
 
-	_, err := svc.Authorize("", "")
+	_, err := svc.Authorize(context.Background(), "", "")
 	if assert.Error(err) {
 		assert.Equal(err.Error(), "Authentication failed")
 	}
 }
+
+func TestNewServiceWithoutCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewService(Config{BaseURL: "ecapis.qdm.cloud", ClientID: "client"})
+	assert.EqualError(err, "missing client credentials")
+}
@@ -0,0 +1,266 @@
+package qdm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Invalid takes the place of a record that could not be decoded in the items
+// of an iterator, so that the consumer can set it aside and carry on.
+type Invalid struct {
+	Entity string
+	Raw    json.RawMessage // 原始資料
+	Err    error
+}
+
+func (i *Invalid) Error() string {
+	return fmt.Sprintf("invalid %s record: %v", i.Entity, i.Err)
+}
+
+func (i *Invalid) Unwrap() error {
+	return i.Err
+}
+
+// idleBody fails a read of a response body that waits longer than timeout for
+// data, canceling the request, as the transport only times out waiting for
+// the headers. The time the reader spends between reads does not count.
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+	cancel  context.CancelFunc
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleBody {
+	b := &idleBody{
+		ReadCloser: body,
+		timeout:    timeout,
+		cancel:     cancel,
+	}
+
+	b.timer = time.AfterFunc(timeout, func() {
+		b.expired.Store(true)
+		cancel()
+	})
+	b.timer.Stop()
+
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+
+	if b.expired.Load() {
+		return n, fmt.Errorf("read timeout: no data received for %s", b.timeout)
+	}
+
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.Stop()
+	defer b.cancel()
+
+	return b.ReadCloser.Close()
+}
+
+// Page is the pagination part of a result page decoded by decodeStream.
+type Page struct {
+	Count          int              // 擷取筆數
+	TotalCount     int              // 符合筆數
+	SearchCriteria ResultPagination // 分頁參數
+}
+
+// decodeStream walks the result envelope read from r token by token and calls
+// yield with every element of data.result as soon as it has been decoded, so
+// that a page never has to be held in memory as a whole. An element that is
+// valid JSON but does not decode into T is handed to invalid, or fails the
+// page when invalid is nil.
+func decodeStream[T any](r io.Reader, yield func(T) error, invalid func(raw json.RawMessage, err error) error) (*Page, error) {
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	var (
+		page    *Page
+		message string
+		failed  bool
+	)
+
+	for dec.More() {
+		key, err := nextKey(dec)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case strings.EqualFold(key, "meta"):
+			var meta struct {
+				Error bool
+			}
+
+			if err := dec.Decode(&meta); err != nil {
+				return nil, err
+			}
+
+			failed = meta.Error
+
+		case strings.EqualFold(key, "data"):
+			page, message, err = decodePage(dec, yield, invalid)
+			if err != nil {
+				return nil, err
+			}
+
+		default:
+			if err := skipValue(dec); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	if failed {
+		return nil, errors.New(message)
+	}
+
+	if page == nil {
+		return nil, errors.New("missing data")
+	}
+
+	return page, nil
+}
+
+func decodePage[T any](dec *json.Decoder, yield func(T) error, invalid func(json.RawMessage, error) error) (*Page, string, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, "", err
+	}
+
+	var (
+		page    Page
+		message string
+	)
+
+	for dec.More() {
+		key, err := nextKey(dec)
+		if err != nil {
+			return nil, "", err
+		}
+
+		switch key {
+		case "count":
+			err = dec.Decode(&page.Count)
+
+		case "total_count":
+			err = dec.Decode(&page.TotalCount)
+
+		case "search_criteria":
+			err = dec.Decode(&page.SearchCriteria)
+
+		case "message":
+			err = dec.Decode(&message)
+
+		case "result":
+			err = decodeArray(dec, yield, invalid)
+
+		default:
+			err = skipValue(dec)
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, "", err
+	}
+
+	return &page, message, nil
+}
+
+func decodeArray[T any](dec *json.Decoder, yield func(T) error, invalid func(json.RawMessage, error) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if tok == nil {
+		return nil // "result": null
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("unexpected token %v, want [", tok)
+	}
+
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+
+		var v T
+		if err := json.Unmarshal(raw, &v); err != nil {
+			if invalid == nil {
+				return err
+			}
+
+			if err := invalid(raw, err); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := yield(v); err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+func nextKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected token %v, want object key", tok)
+	}
+
+	return key, nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("unexpected token %v, want %v", tok, want)
+	}
+
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var raw json.RawMessage
+	return dec.Decode(&raw)
+}
@@ -0,0 +1,106 @@
+package qdm
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestDecodeStream(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{
+		"meta": {"error": false, "status": 200},
+		"data": {
+			"count": 2,
+			"result": [
+				{"order_id": 1001, "order_items": [{"product_id": 1, "quantity": 2}]},
+				{"order_id": 1002, "order_items": []}
+			],
+			"total_count": 602,
+			"search_criteria": {"page_size": 300, "page_number": 3, "page_count": 3},
+			"unknown": {"nested": [1, 2, 3]}
+		}
+	}`
+
+	var ids []int
+	page, err := decodeStream(strings.NewReader(body), func(o orders.Order) error {
+		ids = append(ids, o.OrderID)
+		return nil
+	}, nil)
+
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]int{1001, 1002}, ids)
+	assert.Equal(2, page.Count)
+	assert.Equal(602, page.TotalCount)
+	assert.Equal(3, page.SearchCriteria.PageCount)
+}
+
+func TestDecodeStreamWithYieldError(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"meta": {"error": false}, "data": {"count": 2, "result": [{"order_id": 1}, {"order_id": 2}]}}`
+
+	stop := errors.New("stop")
+
+	var n int
+	_, err := decodeStream(strings.NewReader(body), func(o orders.Order) error {
+		n++
+		return stop
+	}, nil)
+
+	assert.ErrorIs(err, stop)
+	assert.Equal(1, n)
+}
+
+func TestDecodeStreamWithErrorResult(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"meta": {"error": true, "status": 401}, "data": {"message": "Authentication failed"}}`
+
+	_, err := decodeStream(strings.NewReader(body), func(o orders.Order) error {
+		return nil
+	}, nil)
+
+	if assert.Error(err) {
+		assert.Equal("Authentication failed", err.Error())
+	}
+}
+
+func TestDecodeStreamWithInvalidRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"meta": {"error": false}, "data": {"count": 3, "result": [{"order_id": 1}, {"order_id": "two"}, {"order_id": 3}]}}`
+
+	var (
+		ids     []int
+		invalid []string
+	)
+
+	_, err := decodeStream(strings.NewReader(body), func(o orders.Order) error {
+		ids = append(ids, o.OrderID)
+		return nil
+	}, func(raw json.RawMessage, err error) error {
+		invalid = append(invalid, string(raw))
+		return nil
+	})
+
+	assert.NoError(err)
+	assert.Equal([]int{1, 3}, ids)
+	assert.Equal([]string{`{"order_id": "two"}`}, invalid)
+
+	// without a handler the record fails the page
+	_, err = decodeStream(strings.NewReader(body), func(o orders.Order) error {
+		return nil
+	}, nil)
+
+	assert.Error(err)
+}
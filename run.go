@@ -0,0 +1,157 @@
+package sync
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/validation"
+)
+
+// Result summarizes a finished sync run.
+type Result struct {
+	ID        string // ID of the run in the ledger
+	Entity    string
+	Stored    int64         // records written to the repository
+	Unchanged int64         // records not written as they equal the stored ones
+	Skipped   int64         // records received but not written
+	Failed    int64         // records of batches the repository rejected
+	Duration  time.Duration // time from start to completion
+	APICalls  int64         // QDM API requests made by the run
+	Warnings  []error
+	Err       error
+
+	// Violations lists the business rules the records broke, when the sync
+	// validates them.
+	Violations []validation.Violation
+
+	// ChangedOnly reports that only new or changed records were stored;
+	// Created and Updated split the records stored by how they mutated.
+	ChangedOnly bool
+	Created     int64
+	Updated     int64
+
+	// DryRun reports that nothing was stored; Changes lists what storing
+	// the records would have done instead.
+	DryRun  bool
+	Changes []orders.Change
+}
+
+// Count returns the number of changes of the given type.
+func (r Result) Count(t orders.ChangeType) int64 {
+	var n int64
+	for _, c := range r.Changes {
+		if c.Type == t {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (r Result) String() string {
+	if r.DryRun {
+		return fmt.Sprintf("%s (dry run): %d created, %d updated, %d unchanged, %d skipped, %d failed in %s",
+			r.Entity, r.Count(orders.Created), r.Count(orders.Updated), r.Count(orders.Unchanged),
+			r.Skipped, r.Failed, r.Duration.Round(time.Millisecond))
+	}
+
+	if r.ChangedOnly {
+		return fmt.Sprintf("%s: %d created, %d updated, %d unchanged, %d skipped, %d failed in %s",
+			r.Entity, r.Created, r.Updated, r.Unchanged, r.Skipped, r.Failed, r.Duration.Round(time.Millisecond))
+	}
+
+	return fmt.Sprintf("%s: %d stored, %d skipped, %d failed in %s",
+		r.Entity, r.Stored, r.Skipped, r.Failed, r.Duration.Round(time.Millisecond))
+}
+
+// Run is the handle of a sync started in the background.
+type Run struct {
+	id       string
+	entity   string
+	window   [2]time.Time // 同步區間 (customer_groups 為空)
+	total    int64
+	calls    atomic.Int64
+	release  func() // 釋放鎖定
+	started  time.Time
+	progress chan Progress
+	done     chan struct{}
+	result   Result
+}
+
+func newRun(entity string, total int64) *Run {
+	return &Run{
+		id:       uuid.NewString(),
+		entity:   entity,
+		total:    total,
+		started:  time.Now(),
+		progress: make(chan Progress, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// ID identifies the run in the ledger.
+func (r *Run) ID() string {
+	return r.id
+}
+
+func (r *Run) Entity() string {
+	return r.entity
+}
+
+// Total is the number of records expected when the run started.
+func (r *Run) Total() int64 {
+	return r.total
+}
+
+// Progress streams the progress of the run and is closed once it is done.
+// Updates are not queued: a slow reader only sees the latest one.
+func (r *Run) Progress() <-chan Progress {
+	return r.progress
+}
+
+// Done is closed once the run is done.
+func (r *Run) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait blocks until the run is done and returns its result.
+func (r *Run) Wait() Result {
+	<-r.done
+	return r.result
+}
+
+func (r *Run) report(p Progress) {
+	for {
+		select {
+		case r.progress <- p:
+			return
+
+		default:
+			// replace the update the reader has not picked up yet
+			select {
+			case <-r.progress:
+			default:
+			}
+		}
+	}
+}
+
+// complete fills in the parts of the result the run itself knows.
+func (r *Run) complete(result Result) Result {
+	result.ID = r.id
+	result.Entity = r.entity
+	result.Duration = time.Since(r.started)
+	result.APICalls = r.calls.Load()
+
+	return result
+}
+
+func (r *Run) finish(result Result) {
+	r.result = result
+	close(r.progress)
+	close(r.done)
+}
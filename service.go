@@ -3,22 +3,36 @@ package sync
 import (
 	"context"
 	"errors"
+	"fmt"
+	stdsync "sync"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/mirror520/qdm-sync/orders"
 	"github.com/mirror520/qdm-sync/qdm"
+	"github.com/mirror520/qdm-sync/validation"
 )
 
 type Service interface {
-	SyncOrders(start time.Time, end time.Time) (<-chan Progress, int64, error)
-	SyncCustomers(start time.Time, end time.Time) (<-chan Progress, int64, error)
-	SyncCustomerGroups() (int, error)
+	SyncOrders(ctx context.Context, start time.Time, end time.Time, opts ...qdm.OrderOption) (*Run, error)
+	SyncCustomers(ctx context.Context, start time.Time, end time.Time) (*Run, error)
+	SyncCustomerGroups(ctx context.Context) (*Run, error)
+	SyncAll(ctx context.Context, start time.Time, end time.Time, continueOnError bool) <-chan *Run
+	Verify(ctx context.Context, entity string, start time.Time, end time.Time, bucket time.Duration) ([]Bucket, error)
+	ReconcileDeleted(ctx context.Context, entity string, start time.Time, end time.Time) (*Deletions, error)
+	Validate(ctx context.Context, entity string, start time.Time, end time.Time) (*validation.Report, error)
+	RetryDeadLetters(ctx context.Context, entity string) (*Retried, error)
 	Close()
 }
 
-func NewService(qdm qdm.Service, repo orders.Repository) Service {
+func NewService(qdm qdm.Service, repo orders.Repository, opts ...Option) Service {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &service{
 		log: zap.L().With(
@@ -26,6 +40,7 @@ func NewService(qdm qdm.Service, repo orders.Repository) Service {
 		),
 		qdm:    qdm,
 		orders: repo,
+		opts:   o,
 		ctx:    ctx,
 		cancel: cancel,
 	}
@@ -35,6 +50,7 @@ type service struct {
 	log    *zap.Logger
 	qdm    qdm.Service
 	orders orders.Repository
+	opts   options
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -44,157 +60,339 @@ type Progress struct {
 	Current int64
 }
 
-func (svc *service) SyncOrders(start time.Time, end time.Time) (<-chan Progress, int64, error) {
-	it, err := svc.qdm.FindOrders(start, end)
+// CountMismatch warns that the number of records received differs from the
+// number counted before paging, e.g. because records were added or removed in
+// QDM while the sync was running.
+type CountMismatch struct {
+	Entity   string
+	Expected int64
+	Actual   int64
+}
+
+func (w *CountMismatch) Error() string {
+	return fmt.Sprintf("%s: expected %d records, got %d", w.Entity, w.Expected, w.Actual)
+}
+
+// reconcile warns when the records received differ from the records counted
+// once the iterator is exhausted.
+func reconcile(entity string, it qdm.Iterator) error {
+	if it.Fetched() == it.Expected() {
+		return nil
+	}
+
+	return &CountMismatch{
+		Entity:   entity,
+		Expected: it.Expected(),
+		Actual:   it.Fetched(),
+	}
+}
+
+// SyncOrders syncs the orders added in the window, narrowed by the options,
+// e.g. to the orders of a customer with qdm.WithCustomerID.
+func (svc *service) SyncOrders(ctx context.Context, start time.Time, end time.Time, opts ...qdm.OrderOption) (*Run, error) {
+	ctx, run, span, err := svc.start(ctx, "orders", start, end)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	progress := Progress{
-		Total:   it.Count(),
-		Current: 0,
+	it, err := svc.qdm.FindOrders(ctx, start, end, opts...)
+	if err != nil {
+		return svc.empty(ctx, run, span, err)
 	}
 
-	ch := make(chan Progress)
-	go func(ctx context.Context, it qdm.Iterator, ch chan<- Progress) {
-		log := svc.log.With(
-			zap.String("action", "sync"),
-			zap.String("entity", "orders"),
-			zap.Int64("count", it.Count()),
-		)
+	run.total = it.Count()
+	go svc.run(ctx, span, run, it, storeAs(svc.orders.Store), diffAs(svc.orders.Diff))
 
-		ticker := time.NewTicker(500 * time.Millisecond)
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info("done")
-				return
+	return run, nil
+}
 
-			case <-it.Done():
-				log.Info("done")
-				return
+func (svc *service) SyncCustomers(ctx context.Context, start time.Time, end time.Time) (*Run, error) {
+	ctx, run, span, err := svc.start(ctx, "customers", start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := svc.qdm.FindCustomers(ctx, start, end)
+	if err != nil {
+		return svc.empty(ctx, run, span, err)
+	}
 
-			case <-ticker.C:
-				items, err := it.Fetch(10)
-				if err != nil {
-					if errors.Is(err, qdm.EOF) {
-						it.Close(nil)
+	run.total = it.Count()
+	go svc.run(ctx, span, run, it, storeAs(svc.orders.StoreCustomers), diffAs(svc.orders.DiffCustomers))
 
-						log.Info(err.Error())
-						return
-					}
+	return run, nil
+}
 
-					log.Error(err.Error())
-					return
-				}
+// empty turns a window without records into a finished run, and records the
+// run as failed on any other error.
+func (svc *service) empty(ctx context.Context, run *Run, span trace.Span, err error) (*Run, error) {
+	defer span.End()
 
-				newOrders := make([]orders.Order, len(items))
-				for i, item := range items {
-					order, ok := item.(orders.Order)
-					if !ok {
-						log.Error("type assertion failed")
-						return
-					}
+	if !errors.Is(err, qdm.ErrEmptyData) {
+		recordError(span, err)
+		svc.finish(ctx, run, Result{Err: err, DryRun: svc.opts.dryRun})
+		return nil, err
+	}
 
-					newOrders[i] = order
-				}
+	svc.finish(ctx, run, Result{DryRun: svc.opts.dryRun})
+
+	return run, nil
+}
 
-				if err := svc.orders.Store(newOrders); err != nil {
-					log.Error(err.Error())
-					return
-				}
+// run drives the pipeline of a sync, reporting its progress and finishing
+// the run with the result. In a dry run the records are diffed against the
+// repository instead of being stored.
+func (svc *service) run(ctx context.Context, span trace.Span, run *Run, it qdm.Iterator, store storeFunc, diff diffFunc) {
+	defer span.End()
+
+	log := svc.log.With(
+		zap.String("action", "sync"),
+		zap.String("entity", run.entity),
+		zap.Int64("count", it.Count()),
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(svc.ctx, cancel)
+	defer stop()
+
+	var (
+		mu        stdsync.Mutex
+		result    Result
+		processed int64
+	)
+
+	result.DryRun = svc.opts.dryRun
+	if !result.DryRun && len(svc.opts.sinks) > 0 {
+		store = svc.publishing(run.entity, store, diff)
+	}
 
-				progress.Current += int64(len(newOrders))
+	result.ChangedOnly = svc.opts.changedOnly && !result.DryRun
+	if result.ChangedOnly {
+		store = changedOnly(store, diff, func(created, updated, unchanged int) {
+			mu.Lock()
+			result.Created += int64(created)
+			result.Updated += int64(updated)
+			result.Unchanged += int64(unchanged)
+			mu.Unlock()
+		})
+	}
 
-				ch <- progress
+	if result.DryRun {
+		store = func(ctx context.Context, items []any) error {
+			changes, err := diff(ctx, items)
+			if err != nil {
+				return err
 			}
-		}
-	}(svc.ctx, it, ch)
 
-	return ch, progress.Total, nil
-}
+			mu.Lock()
+			result.Changes = append(result.Changes, changes...)
+			mu.Unlock()
 
-func (svc *service) SyncCustomers(start time.Time, end time.Time) (<-chan Progress, int64, error) {
-	it, err := svc.qdm.FindCustomers(start, end)
-	if err != nil {
-		return nil, 0, err
+			return nil
+		}
 	}
 
-	progress := Progress{
-		Total:   it.Count(),
-		Current: 0,
+	// customers whose orders were stored, their stats are refreshed after
+	var customers map[int]struct{}
+	if svc.opts.customerStats && run.entity == "orders" && !result.DryRun {
+		customers = make(map[int]struct{})
+		store = storedCustomers(store, func(ids []int) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			for _, id := range ids {
+				customers[id] = struct{}{}
+			}
+		})
 	}
 
-	ch := make(chan Progress)
-	go func(ctx context.Context, it qdm.Iterator, ch chan<- Progress) {
-		log := svc.log.With(
-			zap.String("action", "sync"),
-			zap.String("entity", "customers"),
-			zap.Int64("count", it.Count()),
-		)
+	// hooks run before anything looks at the records
+	store = svc.transforming(run.entity, store)
 
-		ticker := time.NewTicker(500 * time.Millisecond)
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info("done")
-				return
+	// records that fail on their own are set aside rather than failing the run
+	store = svc.deadLettering(run, store)
 
-			case <-it.Done():
-				log.Info("done")
-				return
+	// records are validated once as received, retried records included
+	if svc.opts.validate {
+		store = svc.validating(store, func(violations []validation.Violation) {
+			mu.Lock()
+			result.Violations = append(result.Violations, violations...)
+			mu.Unlock()
+		})
+	}
 
-			case <-ticker.C:
-				items, err := it.Fetch(10)
-				if err != nil {
-					if errors.Is(err, qdm.EOF) {
-						it.Close(nil)
+	// writers report concurrently, the lock keeps Current increasing
+	report := func(n int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var dead *deadLettered
+		if errors.As(err, &dead) {
+			result.Failed += int64(dead.n)
+			n -= dead.n
+		} else if err != nil {
+			result.Failed += int64(n)
+			return
+		}
 
-						log.Info(err.Error())
-						return
-					}
+		processed += int64(n)
+		if !result.DryRun {
+			result.Stored += int64(n)
+		}
 
-					log.Error(err.Error())
-					return
-				}
+		run.report(Progress{
+			Total:   it.Count(),
+			Current: processed,
+		})
+	}
 
-				newCustomers := make([]orders.Customer, len(items))
-				for i, item := range items {
-					customer, ok := item.(orders.Customer)
-					if !ok {
-						log.Error("type assertion failed")
-						return
-					}
+	err := svc.pipeline(ctx, run.entity, it, store, report)
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, ErrLockLost) {
+		err = cause
+	}
 
-					newCustomers[i] = customer
-				}
+	it.Close(err)
 
-				if err := svc.orders.StoreCustomers(newCustomers); err != nil {
-					log.Error(err.Error())
-					return
-				}
+	result.Skipped = it.Fetched() - processed - result.Failed
+	result.Stored -= result.Unchanged
+	result.Err = err
 
-				progress.Current += int64(len(newCustomers))
+	if err != nil {
+		recordError(span, err)
+		log.Error(err.Error())
+	} else if warning := reconcile(run.entity, it); warning != nil {
+		result.Warnings = append(result.Warnings, warning)
+		log.Warn(warning.Error())
+	}
 
-				ch <- progress
-			}
+	if len(customers) > 0 {
+		if err := svc.refreshCustomerStats(ctx, customers); err != nil {
+			result.Warnings = append(result.Warnings, err)
+			log.Warn(err.Error())
 		}
-	}(svc.ctx, it, ch)
+	}
 
-	return ch, progress.Total, nil
+	svc.finish(ctx, run, result)
+	log.Info("done", zap.Stringer("result", run.result))
 }
 
-func (svc *service) SyncCustomerGroups() (int, error) {
-	groups, err := svc.qdm.FindCustomerGroups()
+func (svc *service) SyncCustomerGroups(ctx context.Context) (*Run, error) {
+	ctx, run, span, err := svc.start(ctx, "customer_groups", time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	defer span.End()
+
+	groups, err := svc.qdm.FindCustomerGroups(ctx)
+	if err != nil {
+		recordError(span, err)
+		svc.finish(ctx, run, Result{Err: err, DryRun: svc.opts.dryRun})
+		return nil, err
+	}
+
+	run.total = int64(len(groups))
+
+	result := Result{
+		DryRun: svc.opts.dryRun,
+	}
+
+	store := storeAs(svc.orders.StoreCustomerGroups)
+	if len(svc.opts.sinks) > 0 {
+		store = svc.publishing(run.entity, store, diffAs(svc.orders.DiffCustomerGroups))
+	}
+
+	items := make([]any, len(groups))
+	for i, g := range groups {
+		items[i] = g
+	}
+
+	start := time.Now()
+	if result.DryRun {
+		err = svc.transforming(run.entity, func(ctx context.Context, items []any) (err error) {
+			result.Changes, err = diffAs(svc.orders.DiffCustomerGroups)(ctx, items)
+			return err
+		})(ctx, items)
+	} else {
+		err = svc.transforming(run.entity, store)(ctx, items)
+	}
+
+	observeBatch("customer_groups", len(groups), start, err)
 	if err != nil {
-		return 0, err
+		recordError(span, err)
+
+		result.Failed = int64(len(groups))
+		result.Err = err
+	} else {
+		if !result.DryRun {
+			result.Stored = int64(len(groups))
+		}
+
+		run.report(Progress{
+			Total:   int64(len(groups)),
+			Current: int64(len(groups)),
+		})
 	}
 
-	if err := svc.orders.StoreCustomerGroups(groups); err != nil {
-		return 0, err
+	svc.finish(ctx, run, result)
+
+	return run, nil
+}
+
+// SyncAll syncs customer groups, customers and orders one after another, in
+// the order they reference each other. Every run is sent once it has started
+// and the channel is closed after the last one, or after the first failed run
+// unless continueOnError is set.
+func (svc *service) SyncAll(ctx context.Context, start time.Time, end time.Time, continueOnError bool) <-chan *Run {
+	steps := []struct {
+		entity string
+		sync   func(ctx context.Context) (*Run, error)
+	}{
+		{"customer_groups", svc.SyncCustomerGroups},
+		{"customers", func(ctx context.Context) (*Run, error) {
+			return svc.SyncCustomers(ctx, start, end)
+		}},
+		{"orders", func(ctx context.Context) (*Run, error) {
+			return svc.SyncOrders(ctx, start, end)
+		}},
 	}
 
-	return len(groups), nil
+	runs := make(chan *Run, len(steps))
+
+	go func() {
+		defer close(runs)
+
+		ctx, span := startSpan(ctx, "all", start, end)
+		defer span.End()
+
+		for _, step := range steps {
+			run, err := step.sync(ctx)
+			if err != nil {
+				run = newRun(step.entity, 0)
+				run.finish(run.complete(Result{Err: err}))
+			}
+
+			runs <- run
+
+			result := run.Wait()
+			if result.Err == nil {
+				continue
+			}
+
+			recordError(span, result.Err)
+			if !continueOnError {
+				svc.log.Warn("sync aborted",
+					zap.String("action", "sync_all"),
+					zap.String("entity", step.entity),
+					zap.Error(result.Err),
+				)
+				return
+			}
+		}
+	}()
+
+	return runs
 }
 
 func (svc *service) Close() {
@@ -0,0 +1,795 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/qdm"
+)
+
+// fakeIterator hands out items like the QDM iterator, failing with err once
+// they are exhausted when err is set.
+type fakeIterator struct {
+	items    []any
+	expected int64
+	err      error
+	cursor   int
+	done     chan struct{}
+	once     stdsync.Once
+}
+
+func newFakeIterator(items []any) *fakeIterator {
+	return &fakeIterator{
+		items:    items,
+		expected: int64(len(items)),
+		done:     make(chan struct{}),
+	}
+}
+
+func (it *fakeIterator) Fetch(batch int) ([]any, error) {
+	if it.cursor >= len(it.items) {
+		if it.err != nil {
+			return nil, it.err
+		}
+
+		return nil, qdm.EOF
+	}
+
+	end := min(it.cursor+batch, len(it.items))
+	items := it.items[it.cursor:end]
+	it.cursor = end
+
+	return items, nil
+}
+
+func (it *fakeIterator) Count() int64          { return int64(len(it.items)) }
+func (it *fakeIterator) Expected() int64       { return it.expected }
+func (it *fakeIterator) Fetched() int64        { return int64(it.cursor) }
+func (it *fakeIterator) Close(err error)       { it.once.Do(func() { close(it.done) }) }
+func (it *fakeIterator) Done() <-chan struct{} { return it.done }
+func (it *fakeIterator) Error() error          { return it.err }
+
+type fakeQDM struct {
+	qdm.Service
+	orders    *fakeIterator
+	customers *fakeIterator
+	groups    []orders.CustomerGroup
+	orderOpts []qdm.OrderOption
+}
+
+func (f *fakeQDM) FindOrders(ctx context.Context, start time.Time, end time.Time, opts ...qdm.OrderOption) (qdm.Iterator, error) {
+	f.orderOpts = opts
+	return f.orders, nil
+}
+
+func (f *fakeQDM) FindCustomers(ctx context.Context, start time.Time, end time.Time) (qdm.Iterator, error) {
+	return f.customers, nil
+}
+
+func (f *fakeQDM) CountOrders(ctx context.Context, start time.Time, end time.Time, opts ...qdm.OrderOption) (int64, error) {
+	var n int64
+	for _, item := range f.orders.items {
+		if added(item.(orders.Order).DateAdded, start, end) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (f *fakeQDM) CountCustomers(ctx context.Context, start time.Time, end time.Time) (int64, error) {
+	var n int64
+	for _, item := range f.customers.items {
+		if added(item.(orders.Customer).DateAdded, start, end) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (f *fakeQDM) FindCustomerGroups(ctx context.Context) ([]orders.CustomerGroup, error) {
+	return f.groups, nil
+}
+
+type fakeRepository struct {
+	mu        stdsync.Mutex
+	orders    []orders.Order
+	customers []orders.Customer
+	groups    []orders.CustomerGroup
+	deleted   map[int]bool     // soft-deleted order IDs
+	runs      []orders.SyncRun // every ledger write, in order
+	locks     map[string]*fakeLease
+	letters   map[string]orders.DeadLetter
+	rejected  map[int]bool // order IDs failing the batches they are in
+	stats     [][]int      // customers of every stats aggregation
+	err       error
+}
+
+func (repo *fakeRepository) Store(ctx context.Context, o []orders.Order) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.err != nil {
+		return repo.err
+	}
+
+	for _, order := range o {
+		if repo.rejected[order.OrderID] {
+			return fmt.Errorf("%w: order %d", orders.ErrRejected, order.OrderID)
+		}
+	}
+
+	repo.orders = append(repo.orders, o...)
+	return nil
+}
+
+func (repo *fakeRepository) StoreCustomers(ctx context.Context, c []orders.Customer) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.err != nil {
+		return repo.err
+	}
+
+	repo.customers = append(repo.customers, c...)
+	return nil
+}
+
+func (repo *fakeRepository) StoreCustomerGroups(ctx context.Context, g []orders.CustomerGroup) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.err != nil {
+		return repo.err
+	}
+
+	repo.groups = append(repo.groups, g...)
+	return nil
+}
+
+// Diff reports orders with a stored ID as updated when their status differs.
+func (repo *fakeRepository) Diff(ctx context.Context, o []orders.Order) ([]orders.Change, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.err != nil {
+		return nil, repo.err
+	}
+
+	stored := make(map[int]orders.Order)
+	for _, order := range repo.orders {
+		stored[order.OrderID] = order
+	}
+
+	changes := make([]orders.Change, len(o))
+	for i, order := range o {
+		changes[i].ID = order.OrderID
+
+		old, ok := stored[order.OrderID]
+		switch {
+		case !ok:
+			changes[i].Type = orders.Created
+
+		case old.OrderStatus != order.OrderStatus:
+			changes[i].Type = orders.Updated
+			changes[i].Fields = []string{"order_status"}
+
+		default:
+			changes[i].Type = orders.Unchanged
+		}
+	}
+
+	return changes, nil
+}
+
+func (repo *fakeRepository) DiffCustomers(ctx context.Context, c []orders.Customer) ([]orders.Change, error) {
+	changes := make([]orders.Change, len(c))
+	for i, customer := range c {
+		changes[i] = orders.Change{Type: orders.Created, ID: customer.CustomerID}
+	}
+
+	return changes, nil
+}
+
+func (repo *fakeRepository) DiffCustomerGroups(ctx context.Context, g []orders.CustomerGroup) ([]orders.Change, error) {
+	changes := make([]orders.Change, len(g))
+	for i, group := range g {
+		changes[i] = orders.Change{Type: orders.Created, ID: group.CustomerGroupID}
+	}
+
+	return changes, nil
+}
+
+func (repo *fakeRepository) CountOrders(ctx context.Context, start time.Time, end time.Time) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var n int64
+	for _, o := range repo.orders {
+		if added(o.DateAdded, start, end) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (repo *fakeRepository) CountCustomers(ctx context.Context, start time.Time, end time.Time) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var n int64
+	for _, c := range repo.customers {
+		if added(c.DateAdded, start, end) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (repo *fakeRepository) OrderIDs(ctx context.Context, start time.Time, end time.Time) ([]int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var ids []int
+	for _, o := range repo.orders {
+		if added(o.DateAdded, start, end) && !repo.deleted[o.OrderID] {
+			ids = append(ids, o.OrderID)
+		}
+	}
+
+	return ids, nil
+}
+
+func (repo *fakeRepository) CustomerIDs(ctx context.Context, start time.Time, end time.Time) ([]int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var ids []int
+	for _, c := range repo.customers {
+		if added(c.DateAdded, start, end) {
+			ids = append(ids, c.CustomerID)
+		}
+	}
+
+	return ids, nil
+}
+
+func (repo *fakeRepository) OrderCustomerIDs(ctx context.Context, ids []int) ([]int, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var customers []int
+	for _, o := range repo.orders {
+		if slices.Contains(ids, o.OrderID) && o.CustomerID > 0 && !slices.Contains(customers, o.CustomerID) {
+			customers = append(customers, o.CustomerID)
+		}
+	}
+
+	return customers, nil
+}
+
+func (repo *fakeRepository) DeleteOrders(ctx context.Context, ids []int, mode orders.DeleteMode) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.deleted == nil {
+		repo.deleted = make(map[int]bool)
+	}
+
+	remove := make(map[int]bool)
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	kept := repo.orders[:0]
+	for _, o := range repo.orders {
+		if remove[o.OrderID] {
+			if mode == orders.HardDelete {
+				continue
+			}
+
+			repo.deleted[o.OrderID] = true
+		}
+
+		kept = append(kept, o)
+	}
+
+	repo.orders = kept
+	return nil
+}
+
+func (repo *fakeRepository) DeleteCustomers(ctx context.Context, ids []int, mode orders.DeleteMode) error {
+	return errors.New("not implemented")
+}
+
+func (repo *fakeRepository) OrderHistory(ctx context.Context, id int) ([]orders.OrderVersion, error) {
+	return nil, nil
+}
+
+func (repo *fakeRepository) RecordRun(ctx context.Context, run orders.SyncRun) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.runs = append(repo.runs, run)
+	return nil
+}
+
+func (repo *fakeRepository) SyncRuns(ctx context.Context, entity string, limit int) ([]orders.SyncRun, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (repo *fakeRepository) SyncRun(ctx context.Context, id string) (orders.SyncRun, error) {
+	return orders.SyncRun{}, orders.ErrRunNotFound
+}
+
+func (repo *fakeRepository) AggregateCustomerStats(ctx context.Context, ids []int) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.stats = append(repo.stats, ids)
+	return int64(len(ids)), nil
+}
+
+func (repo *fakeRepository) CustomerStats(ctx context.Context, ids []int) ([]orders.CustomerStats, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (repo *fakeRepository) StoreDeadLetters(ctx context.Context, letters []orders.DeadLetter) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.letters == nil {
+		repo.letters = make(map[string]orders.DeadLetter)
+	}
+
+	for _, l := range letters {
+		repo.letters[l.ID] = l
+	}
+
+	return nil
+}
+
+func (repo *fakeRepository) DeadLetters(ctx context.Context, filter orders.DeadLetterFilter) ([]orders.DeadLetter, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var letters []orders.DeadLetter
+	for _, l := range repo.letters {
+		if filter.Entity == "" || l.Entity == filter.Entity {
+			letters = append(letters, l)
+		}
+	}
+
+	return letters, nil
+}
+
+func (repo *fakeRepository) DeleteDeadLetters(ctx context.Context, filter orders.DeadLetterFilter) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var n int64
+	for _, id := range filter.IDs {
+		if _, ok := repo.letters[id]; ok {
+			delete(repo.letters, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (repo *fakeRepository) Lock(ctx context.Context, name string, owner string, ttl time.Duration, force bool) (orders.Lease, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if repo.locks == nil {
+		repo.locks = make(map[string]*fakeLease)
+	}
+
+	if held, ok := repo.locks[name]; ok && held.owner != owner {
+		if !force {
+			return nil, &orders.LockHeld{Lock: orders.Lock{Name: name, Owner: held.owner}}
+		}
+
+		close(held.lost)
+	}
+
+	l := &fakeLease{
+		repo:  repo,
+		name:  name,
+		owner: owner,
+		lost:  make(chan struct{}),
+	}
+
+	repo.locks[name] = l
+	return l, nil
+}
+
+func (repo *fakeRepository) locked(name string) bool {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	_, ok := repo.locks[name]
+	return ok
+}
+
+type fakeLease struct {
+	repo  *fakeRepository
+	name  string
+	owner string
+	lost  chan struct{}
+}
+
+func (l *fakeLease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *fakeLease) Release(ctx context.Context) error {
+	l.repo.mu.Lock()
+	defer l.repo.mu.Unlock()
+
+	if l.repo.locks[l.name] == l {
+		delete(l.repo.locks, l.name)
+	}
+
+	return nil
+}
+
+func added(t orders.QDMTime, start time.Time, end time.Time) bool {
+	ts := time.Time(t)
+	return !ts.Before(start) && !ts.After(end)
+}
+
+func (repo *fakeRepository) Disconnected() error {
+	return nil
+}
+
+func fakeOrders(n int) []any {
+	items := make([]any, n)
+	for i := range items {
+		items[i] = orders.Order{OrderID: i + 1}
+	}
+
+	return items
+}
+
+func TestSyncOrders(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(250))}, repo,
+		WithBatchSize(100),
+		WithWriters(3),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(int64(250), run.Total())
+
+	var last Progress
+	for p := range run.Progress() {
+		assert.GreaterOrEqual(p.Current, last.Current)
+		last = p
+	}
+
+	assert.Equal(int64(250), last.Current)
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Empty(result.Warnings)
+	assert.Equal("orders", result.Entity)
+	assert.Equal(int64(250), result.Stored)
+	assert.Zero(result.Skipped)
+	assert.Zero(result.Failed)
+	assert.Len(repo.orders, 250)
+}
+
+func TestSyncOrdersWithCustomerID(t *testing.T) {
+	assert := assert.New(t)
+
+	q := &fakeQDM{orders: newFakeIterator(fakeOrders(3))}
+	svc := NewService(q, &fakeRepository{})
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now(), qdm.WithCustomerID(7))
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(3), result.Stored)
+	assert.Equal([]qdm.OrderOption{qdm.WithCustomerID(7)}, q.orderOpts)
+}
+
+func TestSyncOrdersWithCountMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	it := newFakeIterator(fakeOrders(90))
+	it.expected = 100
+
+	svc := NewService(&fakeQDM{orders: it}, &fakeRepository{})
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(90), result.Stored)
+
+	var mismatch *CountMismatch
+	if assert.Len(result.Warnings, 1) && assert.ErrorAs(result.Warnings[0], &mismatch) {
+		assert.Equal(int64(100), mismatch.Expected)
+		assert.Equal(int64(90), mismatch.Actual)
+	}
+}
+
+func TestSyncOrdersWithStoreFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	storeErr := errors.New("store failed")
+
+	repo := &fakeRepository{err: storeErr}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(250))}, repo,
+		WithBatchSize(100),
+		WithWriters(1),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	// nobody reads the progress, the run must finish regardless
+	select {
+	case <-run.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail("run not done")
+		return
+	}
+
+	for range run.Progress() {
+	}
+
+	result := run.Wait()
+	assert.ErrorIs(result.Err, storeErr)
+	assert.Equal(int64(100), result.Failed)
+	assert.Zero(result.Stored)
+	assert.Empty(repo.orders)
+}
+
+func TestSyncOrdersWithFetchFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	fetchErr := errors.New("internal error")
+
+	it := newFakeIterator(fakeOrders(150))
+	it.err = fetchErr
+	it.expected = 300
+
+	svc := NewService(&fakeQDM{orders: it}, &fakeRepository{})
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.ErrorIs(result.Err, fetchErr)
+	assert.Equal(int64(150), result.Stored)
+}
+
+func TestSyncOrdersWithDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	items := fakeOrders(30)
+
+	// 10 stored as is, 10 stored with another status, 10 new
+	repo := &fakeRepository{}
+	for i, item := range items[:20] {
+		order := item.(orders.Order)
+		if i >= 10 {
+			order.OrderStatus = 2
+		}
+
+		repo.orders = append(repo.orders, order)
+	}
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithBatchSize(7),
+		WithDryRun(true),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.True(result.DryRun)
+	assert.Zero(result.Stored)
+	assert.Zero(result.Skipped)
+	assert.Equal(int64(10), result.Count(orders.Created))
+	assert.Equal(int64(10), result.Count(orders.Updated))
+	assert.Equal(int64(10), result.Count(orders.Unchanged))
+	assert.Len(repo.orders, 20)
+}
+
+func TestSyncCustomerGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{}
+	groups := []orders.CustomerGroup{{CustomerGroupID: 1}, {CustomerGroupID: 2}}
+
+	svc := NewService(&fakeQDM{groups: groups}, repo)
+	defer svc.Close()
+
+	run, err := svc.SyncCustomerGroups(context.Background())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(2), result.Stored)
+	assert.Len(repo.groups, 2)
+}
+
+func TestSyncWithThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := NewService(&fakeQDM{}, &fakeRepository{},
+		WithBatchSize(10),
+		WithThrottle(20*time.Millisecond),
+	)
+	defer svc.Close()
+
+	it := newFakeIterator(fakeOrders(30))
+
+	start := time.Now()
+	err := svc.(*service).pipeline(context.Background(), "orders", it, func(ctx context.Context, items []any) error {
+		return nil
+	}, func(int, error) {})
+
+	assert.NoError(err)
+	assert.GreaterOrEqual(time.Since(start), 40*time.Millisecond)
+}
+
+func fakeCustomers(n int) []any {
+	items := make([]any, n)
+	for i := range items {
+		items[i] = orders.Customer{CustomerID: i + 1}
+	}
+
+	return items
+}
+
+func TestSyncAll(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{
+		orders:    newFakeIterator(fakeOrders(120)),
+		customers: newFakeIterator(fakeCustomers(30)),
+		groups:    []orders.CustomerGroup{{CustomerGroupID: 1}},
+	}, repo)
+	defer svc.Close()
+
+	var entities []string
+	for run := range svc.SyncAll(context.Background(), time.Now(), time.Now(), false) {
+		result := run.Wait()
+		assert.NoError(result.Err)
+
+		entities = append(entities, result.Entity)
+	}
+
+	assert.Equal([]string{"customer_groups", "customers", "orders"}, entities)
+	assert.Len(repo.groups, 1)
+	assert.Len(repo.customers, 30)
+	assert.Len(repo.orders, 120)
+}
+
+func TestSyncAllWithFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	fetchErr := errors.New("internal error")
+
+	newQDM := func() *fakeQDM {
+		customers := newFakeIterator(fakeCustomers(30))
+		customers.err = fetchErr
+
+		return &fakeQDM{
+			orders:    newFakeIterator(fakeOrders(120)),
+			customers: customers,
+		}
+	}
+
+	// aborts after the failed run
+	svc := NewService(newQDM(), &fakeRepository{})
+	defer svc.Close()
+
+	var results []Result
+	for run := range svc.SyncAll(context.Background(), time.Now(), time.Now(), false) {
+		results = append(results, run.Wait())
+	}
+
+	if assert.Len(results, 2) {
+		assert.ErrorIs(results[1].Err, fetchErr)
+	}
+
+	// continues with the remaining entities
+	repo := &fakeRepository{}
+	svc = NewService(newQDM(), repo)
+	defer svc.Close()
+
+	results = nil
+	for run := range svc.SyncAll(context.Background(), time.Now(), time.Now(), true) {
+		results = append(results, run.Wait())
+	}
+
+	if assert.Len(results, 3) {
+		assert.ErrorIs(results[1].Err, fetchErr)
+		assert.NoError(results[2].Err)
+	}
+	assert.Len(repo.orders, 120)
+}
+
+func TestSyncOrdersWithChangedOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	items := fakeOrders(15)
+	for _, i := range []int{1, 4, 7} {
+		o := items[i].(orders.Order)
+		o.OrderStatus = 3
+		items[i] = o
+	}
+
+	repo := &fakeRepository{}
+	for _, item := range fakeOrders(10) {
+		repo.orders = append(repo.orders, item.(orders.Order))
+	}
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithBatchSize(4),
+		WithChangedOnly(true),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.True(result.ChangedOnly)
+	assert.Equal(int64(8), result.Stored)
+	assert.Equal(int64(5), result.Created)
+	assert.Equal(int64(3), result.Updated)
+	assert.Equal(int64(7), result.Unchanged)
+	assert.Zero(result.Skipped)
+	assert.Len(repo.orders, 18)
+	assert.Contains(result.String(), "5 created, 3 updated, 7 unchanged")
+}
@@ -0,0 +1,74 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+const defaultSubject = "qdm-sync"
+
+// NewNATS publishes every event to the subject <prefix>.<entity>.<type>,
+// e.g. qdm-sync.orders.created, on the NATS server at url.
+func NewNATS(url string, prefix string, timeout time.Duration) (sync.EventSink, error) {
+	if url == "" {
+		return nil, errors.New("nats sink requires a url")
+	}
+
+	if prefix == "" {
+		prefix = defaultSubject
+	}
+
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	conn, err := nats.Connect(url,
+		nats.Name("qdm-sync"),
+		nats.Timeout(timeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &natsSink{
+		conn:    conn,
+		prefix:  prefix,
+		timeout: timeout,
+	}, nil
+}
+
+type natsSink struct {
+	conn    *nats.Conn
+	prefix  string
+	timeout time.Duration
+}
+
+func (sink *natsSink) Publish(ctx context.Context, events []sync.Event) error {
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		subject := sink.prefix + "." + e.Entity + "." + string(e.Type)
+		if err := sink.conn.Publish(subject, data); err != nil {
+			return err
+		}
+	}
+
+	// wait until the server has received the events
+	ctx, cancel := context.WithTimeout(ctx, sink.timeout)
+	defer cancel()
+
+	return sink.conn.FlushWithContext(ctx)
+}
+
+func (sink *natsSink) Close() error {
+	return sink.conn.Drain()
+}
@@ -0,0 +1,82 @@
+package sinks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func runNATSServer(t *testing.T) *server.Server {
+	srv, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Start()
+
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+
+	t.Cleanup(srv.Shutdown)
+
+	return srv
+}
+
+func TestNATS(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := runNATSServer(t)
+
+	conn, err := nats.Connect(srv.ClientURL())
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+
+	msgs := make(chan *nats.Msg, 10)
+
+	sub, err := conn.ChanSubscribe("erp.orders.>", msgs)
+	if !assert.NoError(err) {
+		return
+	}
+	defer sub.Unsubscribe()
+
+	if !assert.NoError(conn.Flush()) {
+		return
+	}
+
+	sink, err := NewNATS(srv.ClientURL(), "erp", 0)
+	if !assert.NoError(err) {
+		return
+	}
+	defer sink.Close()
+
+	err = sink.Publish(context.Background(), testEvents())
+	if !assert.NoError(err) {
+		return
+	}
+
+	var subjects []string
+	for range 2 {
+		select {
+		case msg := <-msgs:
+			subjects = append(subjects, msg.Subject)
+
+		case <-time.After(5 * time.Second):
+			assert.Fail("event not received")
+			return
+		}
+	}
+
+	assert.Equal([]string{"erp.orders.created", "erp.orders.updated"}, subjects)
+}
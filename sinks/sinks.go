@@ -0,0 +1,29 @@
+// Package sinks provides the built-in destinations of the change events
+// published by sync.Service.
+package sinks
+
+import (
+	"errors"
+	"os"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+// New creates the sink described by the configuration.
+func New(cfg sync.Sink) (sync.EventSink, error) {
+	switch cfg.Type {
+	case "file":
+		return NewFile(cfg.Path)
+
+	case "stdout":
+		return NewWriter(os.Stdout), nil
+
+	case "webhook":
+		return NewWebhook(cfg.URL, cfg.Headers, cfg.Timeout)
+
+	case "nats":
+		return NewNATS(cfg.URL, cfg.Subject, cfg.Timeout)
+	}
+
+	return nil, errors.New("unknown sink type: " + cfg.Type)
+}
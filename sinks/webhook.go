@@ -0,0 +1,67 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// NewWebhook POSTs every published batch of events as a JSON array to
+// endpoint. Any status other than 2xx fails the publish.
+func NewWebhook(endpoint string, headers map[string]string, timeout time.Duration) (sync.EventSink, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("webhook sink requires an http(s) url")
+	}
+
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	client := resty.New().
+		SetTimeout(timeout).
+		SetHeaders(headers).
+		SetHeader("Content-Type", "application/json")
+
+	return &webhookSink{
+		client:   client,
+		endpoint: endpoint,
+	}, nil
+}
+
+type webhookSink struct {
+	client   *resty.Client
+	endpoint string
+}
+
+func (sink *webhookSink) Publish(ctx context.Context, events []sync.Event) error {
+	resp, err := sink.client.R().
+		SetContext(ctx).
+		SetBody(events).
+		Post(sink.endpoint)
+	if err != nil {
+		return err
+	}
+
+	if !resp.IsSuccess() {
+		return fmt.Errorf("webhook responded %s", resp.Status())
+	}
+
+	return nil
+}
+
+func (sink *webhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+func TestWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		received []sync.Event
+		token    string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Token")
+
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	sink, err := NewWebhook(srv.URL, map[string]string{"X-Token": "secret"}, 0)
+	if !assert.NoError(err) {
+		return
+	}
+	defer sink.Close()
+
+	err = sink.Publish(context.Background(), testEvents())
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal("secret", token)
+	if assert.Len(received, 2) {
+		assert.Equal(2, received[1].ID)
+		assert.Equal([]string{"order_status"}, received[1].Fields)
+	}
+}
+
+func TestWebhookWithFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	sink, err := NewWebhook(srv.URL, nil, 0)
+	if !assert.NoError(err) {
+		return
+	}
+
+	err = sink.Publish(context.Background(), testEvents())
+	assert.ErrorContains(err, "503")
+
+	_, err = NewWebhook("ftp://example.com", nil, 0)
+	assert.Error(err)
+}
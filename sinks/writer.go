@@ -0,0 +1,64 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	stdsync "sync"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+// NewWriter writes the events to w as newline delimited JSON.
+func NewWriter(w io.Writer) sync.EventSink {
+	return &writerSink{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// NewFile appends the events to the NDJSON file at path.
+func NewFile(path string) (sync.EventSink, error) {
+	if path == "" {
+		return nil, errors.New("file sink requires a path")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writerSink{
+		enc:    json.NewEncoder(f),
+		closer: f,
+	}, nil
+}
+
+type writerSink struct {
+	mu     stdsync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+func (sink *writerSink) Publish(ctx context.Context, events []sync.Event) error {
+	// writers of a sync publish concurrently, keep their lines whole
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	for _, e := range events {
+		if err := sink.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sink *writerSink) Close() error {
+	if sink.closer == nil {
+		return nil
+	}
+
+	return sink.closer.Close()
+}
@@ -0,0 +1,94 @@
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+
+	sync "github.com/mirror520/qdm-sync"
+)
+
+func testEvents() []sync.Event {
+	return []sync.Event{
+		{
+			Type:   orders.Created,
+			Entity: "orders",
+			ID:     1,
+			Record: orders.Order{OrderID: 1},
+			Time:   time.Now(),
+		},
+		{
+			Type:   orders.Updated,
+			Entity: "orders",
+			ID:     2,
+			Fields: []string{"order_status"},
+			Record: orders.Order{OrderID: 2, OrderStatus: 3},
+			Time:   time.Now(),
+		},
+	}
+}
+
+func TestWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+
+	sink := NewWriter(&buf)
+	defer sink.Close()
+
+	err := sink.Publish(context.Background(), testEvents())
+	if !assert.NoError(err) {
+		return
+	}
+
+	var types []orders.ChangeType
+
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e struct {
+			Type   orders.ChangeType `json:"type"`
+			Record orders.Order      `json:"record"`
+		}
+
+		if !assert.NoError(json.Unmarshal(scanner.Bytes(), &e)) {
+			return
+		}
+
+		types = append(types, e.Type)
+	}
+
+	assert.Equal([]orders.ChangeType{orders.Created, orders.Updated}, types)
+}
+
+func TestFile(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	// appends across runs
+	for range 2 {
+		sink, err := NewFile(path)
+		if !assert.NoError(err) {
+			return
+		}
+
+		assert.NoError(sink.Publish(context.Background(), testEvents()))
+		assert.NoError(sink.Close())
+	}
+
+	data, err := os.ReadFile(path)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(4, bytes.Count(data, []byte("\n")))
+}
@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// storedCustomers reports the customers of the orders of every batch stored.
+func storedCustomers(store storeFunc, report func(ids []int)) storeFunc {
+	return func(ctx context.Context, items []any) error {
+		if err := store(ctx, items); err != nil {
+			return err
+		}
+
+		ids := make([]int, 0, len(items))
+		for _, item := range items {
+			if o, ok := item.(orders.Order); ok && o.CustomerID > 0 {
+				ids = append(ids, o.CustomerID)
+			}
+		}
+
+		report(ids)
+		return nil
+	}
+}
+
+// refreshCustomerStats aggregates the stats of the customers again.
+func (svc *service) refreshCustomerStats(ctx context.Context, customers map[int]struct{}) error {
+	ids := make([]int, 0, len(customers))
+	for id := range customers {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+
+	ctx, span := tracer.Start(ctx, "aggregate.customer_stats")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("aggregate.customers", len(ids)))
+
+	n, err := svc.orders.AggregateCustomerStats(ctx, ids)
+	if err != nil {
+		recordError(span, err)
+		return fmt.Errorf("customer stats not refreshed: %w", err)
+	}
+
+	svc.log.Info("customer stats refreshed",
+		zap.String("action", "aggregate"),
+		zap.Int64("customers", n),
+	)
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestSyncOrdersRefreshesCustomerStats(t *testing.T) {
+	assert := assert.New(t)
+
+	items := fakeOrders(10)
+	for i, item := range items {
+		o := item.(orders.Order)
+		o.CustomerID = i % 3 // customer 0 is a guest
+		items[i] = o
+	}
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithBatchSize(4),
+		WithCustomerStats(true),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Empty(result.Warnings)
+	assert.Equal([][]int{{1, 2}}, repo.stats)
+}
+
+func TestSyncOrdersWithDryRunKeepsCustomerStats(t *testing.T) {
+	assert := assert.New(t)
+
+	items := fakeOrders(10)
+	for i, item := range items {
+		o := item.(orders.Order)
+		o.CustomerID = 1
+		items[i] = o
+	}
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithCustomerStats(true),
+		WithDryRun(true),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	run.Wait()
+	assert.Empty(repo.stats)
+}
+
+func TestReconcileDeletedRefreshesCustomerStats(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now()
+
+	// orders 3 and 4 of customer 2 and a guest were removed in QDM
+	repo := &fakeRepository{}
+	var items []any
+	for i, item := range fakeOrders(5) {
+		o := item.(orders.Order)
+		o.CustomerID = i % 3 // customer 0 is a guest
+		o.DateAdded = orders.QDMTime(start.Add(time.Minute))
+		repo.orders = append(repo.orders, o)
+
+		if o.OrderID != 3 && o.OrderID != 4 {
+			items = append(items, o)
+		}
+	}
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo,
+		WithCustomerStats(true),
+	)
+	defer svc.Close()
+
+	report, err := svc.ReconcileDeleted(context.Background(), "orders", start, end)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal([]int{3, 4}, report.IDs)
+	assert.Empty(report.Warnings)
+	assert.Equal([][]int{{2}}, repo.stats)
+}
@@ -0,0 +1,102 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/mirror520/qdm-sync")
+
+type Tracing struct {
+	Exporter    string            `yaml:"exporter"`    // otlp, stdout (printed to stderr) or empty to disable
+	Endpoint    string            `yaml:"endpoint"`    // OTLP/HTTP collector endpoint (host:port)
+	Insecure    bool              `yaml:"insecure"`    // disables TLS towards the collector
+	Headers     map[string]string `yaml:"headers"`     // extra headers sent to the collector
+	SampleRatio float64           `yaml:"sampleRatio"` // fraction of runs traced, 0 means always
+}
+
+// SetupTracing installs the global tracer provider described by cfg and
+// returns a function that flushes and stops it. When no exporter is
+// configured the global no-op provider is kept.
+func SetupTracing(ctx context.Context, cfg Tracing) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+
+	case "stdout":
+		// stdout itself may carry the events of a stdout sink
+		exp, err := stdouttrace.New(
+			stdouttrace.WithWriter(os.Stderr),
+			stdouttrace.WithPrettyPrint(),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter = exp
+
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter = exp
+
+	default:
+		return nil, errors.New("unsupported tracing exporter: " + cfg.Exporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "qdm-sync"),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}
+
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,183 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// WithOrderTransform registers a hook that may change an order or reject it
+// with an error before it is diffed, published and stored. Hooks run in the
+// order they are registered.
+func WithOrderTransform(fn func(*orders.Order) error) Option {
+	return transformOption(func(o *options) {
+		o.orderTransforms = append(o.orderTransforms, fn)
+	})
+}
+
+// WithCustomerTransform registers a hook run on every customer, like
+// WithOrderTransform.
+func WithCustomerTransform(fn func(*orders.Customer) error) Option {
+	return transformOption(func(o *options) {
+		o.customerTransforms = append(o.customerTransforms, fn)
+	})
+}
+
+// WithCustomerGroupTransform registers a hook run on every customer group,
+// like WithOrderTransform.
+func WithCustomerGroupTransform(fn func(*orders.CustomerGroup) error) Option {
+	return transformOption(func(o *options) {
+		o.groupTransforms = append(o.groupTransforms, fn)
+	})
+}
+
+type transformOption func(*options)
+
+func (opt transformOption) apply(o *options) {
+	opt(o)
+}
+
+// transform runs the hooks of the entity over the items in place.
+func (svc *service) transform(entity string, items []any) error {
+	var err error
+	switch entity {
+	case "orders":
+		err = transformAs(svc.opts.orderTransforms, items)
+
+	case "customers":
+		err = transformAs(svc.opts.customerTransforms, items)
+
+	case "customer_groups":
+		err = transformAs(svc.opts.groupTransforms, items)
+	}
+
+	if err != nil {
+		return &transformError{entity, err}
+	}
+
+	return nil
+}
+
+// transformError is a record rejected by a hook.
+type transformError struct {
+	entity string
+	err    error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("transform %s: %v", e.entity, e.err)
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+func (e *transformError) Is(target error) bool {
+	return target == orders.ErrRejected
+}
+
+// transforming transforms copies of the items before storing them, leaving
+// the items, and the data they hold, as they came for a retry.
+func (svc *service) transforming(entity string, store storeFunc) storeFunc {
+	return func(ctx context.Context, items []any) error {
+		items = slices.Clone(items)
+		if err := svc.transform(entity, items); err != nil {
+			return err
+		}
+
+		return store(ctx, items)
+	}
+}
+
+func transformAs[T any](fns []func(*T) error, items []any) error {
+	if len(fns) == 0 {
+		return nil
+	}
+
+	for i, item := range items {
+		record, ok := item.(T)
+		if !ok {
+			return errors.New("type assertion failed")
+		}
+
+		// hooks may change the items of an order, not only its fields
+		record = deepCopy(reflect.ValueOf(record)).Interface().(T)
+
+		for _, fn := range fns {
+			if err := fn(&record); err != nil {
+				return err
+			}
+		}
+
+		items[i] = record
+	}
+
+	return nil
+}
+
+// deepCopy copies a value along with the slices, maps and pointers it holds
+// in exported fields.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := range v.Len() {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+
+		return c
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+
+		return c
+
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopy(v.Elem()))
+		return c
+
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+
+		for i := range v.NumField() {
+			if f := c.Field(i); f.CanSet() {
+				f.Set(deepCopy(v.Field(i)))
+			}
+		}
+
+		return c
+	}
+
+	return v
+}
@@ -0,0 +1,67 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestSyncOrdersWithTransform(t *testing.T) {
+	assert := assert.New(t)
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(10))}, repo,
+		WithOrderTransform(func(o *orders.Order) error {
+			o.ShippingTelephone = "+886-912-345-678"
+			return nil
+		}),
+		WithOrderTransform(func(o *orders.Order) error {
+			// sees the changes of the hooks before it
+			if o.ShippingTelephone == "+886-912-345-678" {
+				o.ShippingTelephone = "0912345678"
+			}
+
+			return nil
+		}),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	if assert.Len(repo.orders, 10) {
+		assert.Equal("0912345678", repo.orders[0].ShippingTelephone)
+	}
+}
+
+func TestSyncWithRejectingTransform(t *testing.T) {
+	assert := assert.New(t)
+
+	invalid := errors.New("invalid group")
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{groups: []orders.CustomerGroup{{CustomerGroupID: 1}}}, repo,
+		WithCustomerGroupTransform(func(g *orders.CustomerGroup) error {
+			return invalid
+		}),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncCustomerGroups(context.Background())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.ErrorIs(result.Err, invalid)
+	assert.Empty(repo.groups)
+}
@@ -0,0 +1,115 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mirror520/qdm-sync/qdm"
+	"github.com/mirror520/qdm-sync/validation"
+)
+
+// validator returns the configured rules or the built-in ones.
+func (svc *service) validator() *validation.Engine {
+	if svc.opts.validator != nil {
+		return svc.opts.validator
+	}
+
+	engine, _ := validation.New(nil, nil, nil)
+	return engine
+}
+
+// validating reports the violations of the records of a batch before storing
+// them; records are stored whether or not they are valid.
+func (svc *service) validating(store storeFunc, report func([]validation.Violation)) storeFunc {
+	engine := svc.validator()
+
+	return func(ctx context.Context, items []any) error {
+		var violations []validation.Violation
+		for _, item := range items {
+			violations = append(violations, engine.Validate(item)...)
+		}
+
+		if len(violations) > 0 {
+			report(violations)
+		}
+
+		return store(ctx, items)
+	}
+}
+
+// Validate checks the records of an entity QDM has for a window against the
+// rules of the validator, storing nothing.
+func (svc *service) Validate(ctx context.Context, entity string, start time.Time, end time.Time) (*validation.Report, error) {
+	var find func(ctx context.Context, start time.Time, end time.Time) (qdm.Iterator, error)
+	switch entity {
+	case "orders":
+		find = func(ctx context.Context, start time.Time, end time.Time) (qdm.Iterator, error) {
+			return svc.qdm.FindOrders(ctx, start, end)
+		}
+
+	case "customers":
+		find = svc.qdm.FindCustomers
+
+	default:
+		return nil, errors.New("entity not validatable: " + entity)
+	}
+
+	engine := svc.validator()
+
+	ctx, span := tracer.Start(ctx, "validate."+entity,
+		trace.WithAttributes(
+			attribute.String("sync.entity", entity),
+			attribute.String("sync.start", start.Format(time.RFC3339)),
+			attribute.String("sync.end", end.Format(time.RFC3339)),
+		),
+	)
+	defer span.End()
+
+	report := &validation.Report{Entity: entity}
+
+	it, err := find(ctx, start, end)
+	if err != nil {
+		if errors.Is(err, qdm.ErrEmptyData) {
+			return report, nil
+		}
+
+		recordError(span, err)
+		return nil, err
+	}
+	defer it.Close(nil)
+
+	for {
+		items, err := it.Fetch(svc.opts.batchSize)
+		if err != nil {
+			if errors.Is(err, qdm.EOF) {
+				break
+			}
+
+			recordError(span, err)
+			return nil, err
+		}
+
+		for _, item := range items {
+			report.Checked++
+
+			if invalid, ok := item.(*qdm.Invalid); ok {
+				report.Violations = append(report.Violations, validation.Violation{
+					Rule:    "decode",
+					Entity:  entity,
+					Message: invalid.Err.Error(),
+				})
+				continue
+			}
+
+			report.Violations = append(report.Violations, engine.Validate(item)...)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("validate.violations", len(report.Violations)))
+
+	return report, nil
+}
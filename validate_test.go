@@ -0,0 +1,63 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+	"github.com/mirror520/qdm-sync/validation"
+)
+
+func TestSyncOrdersWithValidator(t *testing.T) {
+	assert := assert.New(t)
+
+	engine, err := validation.New(nil, []validation.Spec{{Name: "even", Assert: "order_id % 2 == 0"}}, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(fakeOrders(10))}, repo,
+		WithBatchSize(3),
+		WithValidator(engine),
+		WithValidation(true),
+	)
+	defer svc.Close()
+
+	run, err := svc.SyncOrders(context.Background(), time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	result := run.Wait()
+	assert.NoError(result.Err)
+	assert.Equal(int64(10), result.Stored, "invalid records are stored all the same")
+	assert.Len(result.Violations, 5)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	items := fakeOrders(3)
+	items[1] = orders.Order{OrderID: 2, PaymentStatus: "PAID"}
+
+	repo := &fakeRepository{}
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo)
+	defer svc.Close()
+
+	report, err := svc.Validate(context.Background(), "orders", time.Now(), time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(int64(3), report.Checked)
+	if assert.Len(report.Violations, 1) {
+		assert.Equal("paid_without_payment_time", report.Violations[0].Rule)
+		assert.Equal(2, report.Violations[0].RecordID)
+	}
+
+	assert.Empty(repo.orders)
+}
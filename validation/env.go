@@ -0,0 +1,66 @@
+package validation
+
+import (
+	"reflect"
+	"strings"
+)
+
+// env is a record as assertions see it: its fields keyed by their bson
+// names, like the stored documents the mappings derive fields from. Nested
+// records and their slices are keyed the same way; values without bson
+// fields, such as dates, are left as they are.
+func env(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]any, v.NumField())
+		for i := range v.NumField() {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			name, ok := bsonName(f)
+			if !ok {
+				continue
+			}
+
+			fields[name] = env(v.Field(i))
+		}
+
+		if len(fields) == 0 {
+			return v.Interface()
+		}
+
+		return fields
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return v.Interface()
+		}
+
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = env(v.Index(i))
+		}
+
+		return items
+	}
+
+	return v.Interface()
+}
+
+// bsonName is the name of a field in its bson document, lowercased when the
+// tag leaves it out as the bson encoder does.
+func bsonName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("bson")
+	if tag == "-" {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = strings.ToLower(f.Name)
+	}
+
+	return name, true
+}
@@ -0,0 +1,92 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// Rule checks a record, returning the violations found or none.
+type Rule[T any] struct {
+	Name  string
+	Check func(T) []string
+}
+
+// OrderRules are the built-in rules of orders.
+func OrderRules() []Rule[orders.Order] {
+	return []Rule[orders.Order]{
+		{"order_total", orderTotal},
+		{"item_total", itemTotal},
+		{"paid_without_payment_time", paidWithoutPaymentTime},
+		{"shipped_without_tracking_number", shippedWithoutTrackingNumber},
+	}
+}
+
+// CustomerRules are the built-in rules of customers.
+func CustomerRules() []Rule[orders.Customer] {
+	return []Rule[orders.Customer]{
+		{"customer_email", customerEmail},
+	}
+}
+
+// orderTotal expects the total to be the item totals plus the shipping fee,
+// less the promotion discounts and the rewards used.
+func orderTotal(o orders.Order) []string {
+	var items int
+	for _, item := range o.OrderItems {
+		items += item.Total
+	}
+
+	want := float64(items + o.ShippingFee - o.PromotionDiscountTotal - o.RewardUsed)
+	if o.Total == want {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("total %v, want %v (items %d + shipping %d - discounts %d - rewards %d)",
+		o.Total, want, items, o.ShippingFee, o.PromotionDiscountTotal, o.RewardUsed)}
+}
+
+func itemTotal(o orders.Order) []string {
+	var violations []string
+	for _, item := range o.OrderItems {
+		if item.Total != item.Price*item.Quantity {
+			violations = append(violations, fmt.Sprintf("item %d total %d, want %d x %d",
+				item.ProductID, item.Total, item.Price, item.Quantity))
+		}
+	}
+
+	return violations
+}
+
+func paidWithoutPaymentTime(o orders.Order) []string {
+	if o.PaymentStatus != "PAID" || !time.Time(o.PaymentTime).IsZero() {
+		return nil
+	}
+
+	return []string{"paid without payment time"}
+}
+
+// shippedStatuses are the shipping statuses of parcels that left the store.
+var shippedStatuses = map[string]bool{
+	"SHIPPED":   true,
+	"PICKREADY": true,
+	"DELIVERED": true,
+}
+
+func shippedWithoutTrackingNumber(o orders.Order) []string {
+	if !shippedStatuses[o.ShippingStatus] || o.TrackingNumber != "" {
+		return nil
+	}
+
+	return []string{strings.ToLower(o.ShippingStatus) + " without tracking number"}
+}
+
+func customerEmail(c orders.Customer) []string {
+	if c.Email == "" || strings.Contains(c.Email, "@") {
+		return nil
+	}
+
+	return []string{"invalid email " + c.Email}
+}
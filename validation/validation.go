@@ -0,0 +1,193 @@
+// Package validation checks orders and customers against business rules,
+// built in or written as expressions, and reports the violations.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+// Spec is a configured rule: Assert is an expr-lang expression over the
+// fields of the record by their stored names (e.g. total >= 0) that must
+// hold.
+type Spec struct {
+	Name    string `yaml:"name"`
+	Assert  string `yaml:"assert"`
+	Message string `yaml:"message"` // defaults to the assertion
+}
+
+// Violation is a rule a record does not satisfy.
+type Violation struct {
+	Rule     string `json:"rule"`
+	Entity   string `json:"entity"`
+	RecordID int    `json:"record_id"`
+	Message  string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s %d: %s: %s", v.Entity, v.RecordID, v.Rule, v.Message)
+}
+
+// Engine validates records with the built-in rules that are not disabled and
+// the configured ones.
+type Engine struct {
+	orders    []Rule[orders.Order]
+	customers []Rule[orders.Customer]
+}
+
+// New compiles the configured rules of orders and customers. Disabled names
+// built-in rules to skip.
+func New(disabled []string, orderSpecs []Spec, customerSpecs []Spec) (*Engine, error) {
+	known := make(map[string]bool)
+
+	e := new(Engine)
+	for _, r := range OrderRules() {
+		known[r.Name] = true
+		if !slices.Contains(disabled, r.Name) {
+			e.orders = append(e.orders, r)
+		}
+	}
+
+	for _, r := range CustomerRules() {
+		known[r.Name] = true
+		if !slices.Contains(disabled, r.Name) {
+			e.customers = append(e.customers, r)
+		}
+	}
+
+	for _, name := range disabled {
+		if !known[name] {
+			return nil, errors.New("validation: unknown rule " + name)
+		}
+	}
+
+	for _, spec := range orderSpecs {
+		r, err := compile[orders.Order](spec)
+		if err != nil {
+			return nil, err
+		}
+
+		e.orders = append(e.orders, r)
+	}
+
+	for _, spec := range customerSpecs {
+		r, err := compile[orders.Customer](spec)
+		if err != nil {
+			return nil, err
+		}
+
+		e.customers = append(e.customers, r)
+	}
+
+	return e, nil
+}
+
+func compile[T any](spec Spec) (Rule[T], error) {
+	if spec.Name == "" {
+		return Rule[T]{}, errors.New("validation: rule name required")
+	}
+
+	var zero T
+	program, err := expr.Compile(spec.Assert, expr.Env(env(reflect.ValueOf(zero))), expr.AsBool())
+	if err != nil {
+		return Rule[T]{}, fmt.Errorf("validation: rule %s: %w", spec.Name, err)
+	}
+
+	message := spec.Message
+	if message == "" {
+		message = "not " + spec.Assert
+	}
+
+	return Rule[T]{
+		Name:  spec.Name,
+		Check: assertion[T](program, message),
+	}, nil
+}
+
+func assertion[T any](program *vm.Program, message string) func(T) []string {
+	return func(record T) []string {
+		ok, err := expr.Run(program, env(reflect.ValueOf(record)))
+		if err != nil {
+			return []string{err.Error()}
+		}
+
+		if ok.(bool) {
+			return nil
+		}
+
+		return []string{message}
+	}
+}
+
+// Validate checks an order or a customer; other records have no rules.
+func (e *Engine) Validate(record any) []Violation {
+	switch r := record.(type) {
+	case orders.Order:
+		return check(e.orders, "orders", r.OrderID, r)
+
+	case orders.Customer:
+		return check(e.customers, "customers", r.CustomerID, r)
+	}
+
+	return nil
+}
+
+func check[T any](rules []Rule[T], entity string, id int, record T) []Violation {
+	var violations []Violation
+	for _, r := range rules {
+		for _, msg := range r.Check(record) {
+			violations = append(violations, Violation{
+				Rule:     r.Name,
+				Entity:   entity,
+				RecordID: id,
+				Message:  msg,
+			})
+		}
+	}
+
+	return violations
+}
+
+// Report collects the violations of the records checked.
+type Report struct {
+	Entity     string      `json:"entity"`
+	Checked    int64       `json:"checked"`
+	Violations []Violation `json:"violations"`
+}
+
+// RuleCount is the number of violations of a rule.
+type RuleCount struct {
+	Rule  string
+	Count int
+}
+
+// ByRule counts the violations of every rule, most violated first.
+func (r *Report) ByRule() []RuleCount {
+	counts := make(map[string]int)
+	for _, v := range r.Violations {
+		counts[v.Rule]++
+	}
+
+	result := make([]RuleCount, 0, len(counts))
+	for rule, n := range counts {
+		result = append(result, RuleCount{rule, n})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+
+		return result[i].Rule < result[j].Rule
+	})
+
+	return result
+}
@@ -0,0 +1,134 @@
+package validation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func validOrder() orders.Order {
+	return orders.Order{
+		OrderID: 1,
+		OrderItems: []orders.OrderItem{
+			{ProductID: 10, Price: 100, Quantity: 2, Total: 200},
+			{ProductID: 11, Price: 50, Quantity: 1, Total: 50},
+		},
+		ShippingFee:            60,
+		PromotionDiscountTotal: 30,
+		RewardUsed:             10,
+		Total:                  270,
+		PaymentStatus:          "PAID",
+		PaymentTime:            orders.QDMTime(time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local)),
+		ShippingStatus:         "SHIPPED",
+		TrackingNumber:         "TW123",
+	}
+}
+
+func rules(violations []Violation) []string {
+	var names []string
+	for _, v := range violations {
+		names = append(names, v.Rule)
+	}
+
+	return names
+}
+
+func TestBuiltInRules(t *testing.T) {
+	assert := assert.New(t)
+
+	engine, err := New(nil, nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Empty(engine.Validate(validOrder()))
+
+	o := validOrder()
+	o.OrderItems[1].Total = 40 // also breaks the order total
+	o.PaymentTime = orders.QDMTime{}
+	o.TrackingNumber = ""
+
+	violations := engine.Validate(o)
+	assert.Equal([]string{
+		"order_total",
+		"item_total",
+		"paid_without_payment_time",
+		"shipped_without_tracking_number",
+	}, rules(violations))
+
+	for _, v := range violations {
+		assert.Equal("orders", v.Entity)
+		assert.Equal(1, v.RecordID)
+	}
+
+	assert.Equal([]string{"customer_email"},
+		rules(engine.Validate(orders.Customer{CustomerID: 2, Email: "nobody"})))
+}
+
+func TestConfiguredRules(t *testing.T) {
+	assert := assert.New(t)
+
+	engine, err := New(
+		[]string{"order_total"},
+		[]Spec{
+			{Name: "positive_total", Assert: "total > 0", Message: "total not positive"},
+			{Name: "priced_items", Assert: "all(order_items, .price > 0)"},
+		},
+		[]Spec{{Name: "approved", Assert: "approved == 1"}},
+	)
+	if !assert.NoError(err) {
+		return
+	}
+
+	o := validOrder()
+	o.Total = 0
+
+	violations := engine.Validate(o)
+	if assert.Len(violations, 1) {
+		assert.Equal("positive_total", violations[0].Rule)
+		assert.Equal("total not positive", violations[0].Message)
+	}
+
+	o = validOrder()
+	o.OrderItems[0].Price = 0
+	o.OrderItems[0].Total = 0
+
+	assert.Equal([]string{"priced_items"}, rules(engine.Validate(o)))
+
+	violations = engine.Validate(orders.Customer{CustomerID: 2})
+	if assert.Len(violations, 1) {
+		assert.Equal("not approved == 1", violations[0].Message)
+	}
+}
+
+func TestNewWithInvalidRules(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := New([]string{"unknown"}, nil, nil)
+	assert.Error(err)
+
+	_, err = New(nil, []Spec{{Name: "typo", Assert: "totl > 0"}}, nil)
+	assert.Error(err)
+
+	// fields are named as stored, not as in Go
+	_, err = New(nil, []Spec{{Name: "go_name", Assert: "Total > 0"}}, nil)
+	assert.Error(err)
+
+	_, err = New(nil, []Spec{{Name: "not_bool", Assert: "total"}}, nil)
+	assert.Error(err)
+}
+
+func TestReportByRule(t *testing.T) {
+	assert := assert.New(t)
+
+	report := &Report{
+		Violations: []Violation{
+			{Rule: "item_total"}, {Rule: "order_total"}, {Rule: "order_total"},
+		},
+	}
+
+	assert.Equal([]RuleCount{{"order_total", 2}, {"item_total", 1}}, report.ByRule())
+}
@@ -0,0 +1,101 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Bucket compares the records QDM counts with the stored ones for a slice of
+// a verified window. Both bounds are inclusive, like the windows of QDM.
+type Bucket struct {
+	Start    time.Time
+	End      time.Time
+	Expected int64 // QDM 筆數
+	Stored   int64 // 資料庫筆數
+}
+
+// Missing is the number of records QDM has that are not stored, negative
+// when more are stored than QDM counts.
+func (b Bucket) Missing() int64 {
+	return b.Expected - b.Stored
+}
+
+func (b Bucket) Matched() bool {
+	return b.Expected == b.Stored
+}
+
+// buckets splits [start, end] into consecutive buckets of the given size,
+// the last one ending at end.
+func buckets(start time.Time, end time.Time, size time.Duration) []Bucket {
+	var bs []Bucket
+	for from := start; !from.After(end); from = from.Add(size) {
+		to := from.Add(size - time.Second)
+		if to.After(end) {
+			to = end
+		}
+
+		bs = append(bs, Bucket{Start: from, End: to})
+	}
+
+	return bs
+}
+
+// Verify compares per bucket the records of an entity counted in QDM with the
+// stored ones. Only "orders" and "customers" can be verified, the entities
+// synced by time window.
+func (svc *service) Verify(ctx context.Context, entity string, start time.Time, end time.Time, bucket time.Duration) ([]Bucket, error) {
+	if bucket < time.Second {
+		return nil, errors.New("bucket must be at least one second")
+	}
+
+	var countQDM, countStored func(ctx context.Context, start time.Time, end time.Time) (int64, error)
+	switch entity {
+	case "orders":
+		countQDM = func(ctx context.Context, start time.Time, end time.Time) (int64, error) {
+			return svc.qdm.CountOrders(ctx, start, end)
+		}
+		countStored = svc.orders.CountOrders
+
+	case "customers":
+		countQDM = svc.qdm.CountCustomers
+		countStored = svc.orders.CountCustomers
+
+	default:
+		return nil, errors.New("entity not verifiable: " + entity)
+	}
+
+	ctx, span := tracer.Start(ctx, "verify."+entity,
+		trace.WithAttributes(
+			attribute.String("sync.entity", entity),
+			attribute.String("sync.start", start.Format(time.RFC3339)),
+			attribute.String("sync.end", end.Format(time.RFC3339)),
+		),
+	)
+	defer span.End()
+
+	bs := buckets(start, end, bucket)
+	for i := range bs {
+		b := &bs[i]
+
+		expected, err := countQDM(ctx, b.Start, b.End)
+		if err != nil {
+			recordError(span, err)
+			return nil, err
+		}
+
+		stored, err := countStored(ctx, b.Start, b.End)
+		if err != nil {
+			recordError(span, err)
+			return nil, err
+		}
+
+		b.Expected = expected
+		b.Stored = stored
+	}
+
+	return bs, nil
+}
@@ -0,0 +1,68 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mirror520/qdm-sync/orders"
+)
+
+func TestBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2024, 1, 3, 12, 0, 0, 0, time.Local)
+
+	bs := buckets(start, end, 24*time.Hour)
+	if !assert.Len(bs, 3) {
+		return
+	}
+
+	assert.Equal(start, bs[0].Start)
+	assert.Equal(time.Date(2024, 1, 1, 23, 59, 59, 0, time.Local), bs[0].End)
+	assert.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local), bs[1].Start)
+	assert.Equal(end, bs[2].End)
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	day := func(d int) orders.QDMTime {
+		return orders.QDMTime(time.Date(2024, 1, d, 10, 0, 0, 0, time.Local))
+	}
+
+	// 3 orders per day, the second day lacks one
+	items := fakeOrders(9)
+	repo := &fakeRepository{}
+	for i := range items {
+		order := items[i].(orders.Order)
+		order.DateAdded = day(i/3 + 1)
+		items[i] = order
+
+		if i != 4 {
+			repo.orders = append(repo.orders, order)
+		}
+	}
+
+	svc := NewService(&fakeQDM{orders: newFakeIterator(items)}, repo)
+	defer svc.Close()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	end := time.Date(2024, 1, 3, 23, 59, 59, 0, time.Local)
+
+	bs, err := svc.Verify(context.Background(), "orders", start, end, 24*time.Hour)
+	if !assert.NoError(err) || !assert.Len(bs, 3) {
+		return
+	}
+
+	assert.True(bs[0].Matched())
+	assert.False(bs[1].Matched())
+	assert.Equal(int64(1), bs[1].Missing())
+	assert.True(bs[2].Matched())
+
+	_, err = svc.Verify(context.Background(), "customer_groups", start, end, 24*time.Hour)
+	assert.Error(err)
+}